@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// archivalConformance is the PDF/A level archival requests are exported to.
+const archivalConformance = "2b"
+
+// pdfaValidation is the outcome of checking an archival rendition.
+type pdfaValidation struct {
+	Valid  bool     `json:"valid"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+type pdfFont struct {
+	Name     string
+	Embedded bool
+}
+
+var (
+	pdfaPartRegexp        = regexp.MustCompile("pdfaid:part(?:=[\"']|>)\\s*(\\d)")
+	pdfaConformanceRegexp = regexp.MustCompile("pdfaid:conformance(?:=[\"']|>)\\s*([A-Za-z])")
+)
+
+func validateArchival(req *requestPayload) error {
+	if !req.Archival {
+		return nil
+	}
+	if !contains(req.outputs(), "pdf") {
+		return errors.New("Archival renditions are PDFs, but the pdf output was not requested")
+	}
+	if o := req.PDFOptions; o != nil && o.PDFA != "" && o.PDFA != archivalConformance {
+		return fmt.Errorf("Archival renditions are PDF/A-%v, but pdfa %q was requested", archivalConformance, o.PDFA)
+	}
+	return nil
+}
+
+// pdfOptions are the PDF export options in effect, with archival requests
+// forced to PDF/A.
+func (req *requestPayload) pdfOptions() *pdfOptions {
+	if !req.Archival {
+		return req.PDFOptions
+	}
+	o := pdfOptions{}
+	if req.PDFOptions != nil {
+		o = *req.PDFOptions
+	}
+	o.PDFA = archivalConformance
+	return &o
+}
+
+// validatePDFA checks the PDF/A identification in filename's XMP metadata
+// matches conformance and that every font is embedded. It is not a full
+// veraPDF validation, but catches exports LibreOffice silently downgraded.
+func validatePDFA(ctx context.Context, filename, conformance string) pdfaValidation {
+	var problems []string
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return pdfaValidation{Errors: []string{err.Error()}}
+	}
+	part := pdfaPartRegexp.FindSubmatch(b)
+	level := pdfaConformanceRegexp.FindSubmatch(b)
+	if part == nil || level == nil {
+		problems = append(problems, "No PDF/A identification in the XMP metadata")
+	} else if actual := string(part[1]) + strings.ToLower(string(level[1])); actual != conformance {
+		problems = append(problems, fmt.Sprintf("Identified as PDF/A-%v, expected PDF/A-%v", actual, conformance))
+	}
+	fonts, err := pdfFonts(ctx, filename)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("Could not list fonts: %v", err))
+	}
+	for _, f := range fonts {
+		if !f.Embedded {
+			problems = append(problems, fmt.Sprintf("Font %v is not embedded", f.Name))
+		}
+	}
+	return pdfaValidation{Valid: len(problems) == 0, Errors: problems}
+}
+
+func pdfFonts(ctx context.Context, filename string) ([]pdfFont, error) {
+	var out bytes.Buffer
+	cmd := exec.Command(envString("PDF_FONTS_PATH", "pdffonts"), filename)
+	cmd.Stdout = &out
+	if err := runWithTimeout(ctx, cmd); err != nil {
+		return nil, err
+	}
+	return parsePDFFonts(out.String())
+}
+
+// parsePDFFonts reads pdffonts' table, locating the emb column from the
+// dashed rule under the header since font names may contain spaces.
+func parsePDFFonts(out string) ([]pdfFont, error) {
+	lines := strings.Split(strings.TrimRight(out, "\n"), "\n")
+	if len(lines) < 2 || !strings.HasPrefix(lines[1], "---") {
+		return nil, errors.New("Invalid pdffonts output")
+	}
+	var cols [][2]int
+	start := 0
+	for _, rule := range strings.Split(lines[1], " ") {
+		cols = append(cols, [2]int{start, start + len(rule)})
+		start += len(rule) + 1
+	}
+	if len(cols) < 4 {
+		return nil, errors.New("Invalid pdffonts output")
+	}
+	var fonts []pdfFont
+	for _, line := range lines[2:] {
+		if len(line) < cols[3][1] {
+			continue
+		}
+		fonts = append(fonts, pdfFont{
+			Name:     strings.TrimSpace(line[cols[0][0]:cols[0][1]]),
+			Embedded: strings.TrimSpace(line[cols[3][0]:cols[3][1]]) == "yes",
+		})
+	}
+	return fonts, nil
+}
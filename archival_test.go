@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestValidateArchival(t *testing.T) {
+	for _, test := range []struct {
+		expected string
+		req      requestPayload
+	}{
+		{"", requestPayload{Key: "contract.docx", Archival: true}},
+		{"", requestPayload{Key: "contract.docx", Archival: true, PDFOptions: &pdfOptions{PDFA: "2b"}}},
+		{"Archival renditions are PDFs, but the pdf output was not requested", requestPayload{Key: "contract.docx", Archival: true, Outputs: []string{"docx"}}},
+		{`Archival renditions are PDF/A-2b, but pdfa "1b" was requested`, requestPayload{Key: "contract.docx", Archival: true, PDFOptions: &pdfOptions{PDFA: "1b"}}},
+	} {
+		actual := ""
+		if err := validateArchival(&test.req); err != nil {
+			actual = err.Error()
+		}
+		if actual != test.expected {
+			t.Errorf("Expected %v but got %v", test.expected, actual)
+		}
+	}
+}
+
+func TestArchivalConversion(t *testing.T) {
+	req := requestPayload{Key: "contract.docx", Archival: true, PDFOptions: &pdfOptions{PageRange: "1"}}
+	expected := `pdf:writer_pdf_Export:{"PageRange":{"type":"string","value":"1"},"SelectPdfVersion":{"type":"long","value":2}}`
+	if actual := req.conversion(outputFormats["pdf"]).target(); actual != expected {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+	if req.PDFOptions.PDFA != "" {
+		t.Errorf("Expected the request's options to be left alone but got %v", req.PDFOptions.PDFA)
+	}
+}
+
+func TestValidatePDFA(t *testing.T) {
+	os.Setenv("PDF_FONTS_PATH", "mock-commands/pdffonts")
+	defer os.Unsetenv("PDF_FONTS_PATH")
+	for _, test := range []struct {
+		expected pdfaValidation
+		content  string
+	}{
+		{pdfaValidation{Valid: true}, `<rdf:Description xmlns:pdfaid="http://www.aiim.org/pdfa/ns/id/"><pdfaid:part>2</pdfaid:part><pdfaid:conformance>B</pdfaid:conformance></rdf:Description>`},
+		{pdfaValidation{Valid: true}, `<rdf:Description pdfaid:part="2" pdfaid:conformance="B"/>`},
+		{pdfaValidation{Errors: []string{"Identified as PDF/A-1b, expected PDF/A-2b"}}, `<rdf:Description pdfaid:part="1" pdfaid:conformance="B"/>`},
+		{pdfaValidation{Errors: []string{"No PDF/A identification in the XMP metadata"}}, `%PDF-1.4`},
+	} {
+		f, _ := ioutil.TempFile("", "archival")
+		f.WriteString(test.content)
+		f.Close()
+		defer os.Remove(f.Name())
+		if actual := validatePDFA(context.Background(), f.Name(), "2b"); !reflect.DeepEqual(test.expected, actual) {
+			t.Errorf("Expected %v but got %v", test.expected, actual)
+		}
+	}
+}
+
+func TestParsePDFFonts(t *testing.T) {
+	out := `name                                 type              encoding         emb sub uni object ID
+------------------------------------ ----------------- ---------------- --- --- --- ---------
+BAAAAA+LiberationSerif               TrueType          WinAnsi          yes yes no      10  0
+Times New Roman                      TrueType          WinAnsi          no  no  no      12  0
+`
+	expected := []pdfFont{{"BAAAAA+LiberationSerif", true}, {"Times New Roman", false}}
+	actual, err := parsePDFFonts(out)
+	if err != nil || !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected %v but got %v %v", expected, actual, err)
+	}
+	if _, err := parsePDFFonts("Syntax Error"); err == nil {
+		t.Errorf("Expected error but got nil")
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ngs/docker-libreoffice-s3/signature"
+)
+
+const keyIDHeader = "X-Convserver-Key-Id"
+
+var (
+	errUnauthenticated = errors.New("Missing or invalid credentials")
+	errForbidden       = errors.New("Credentials do not allow this request")
+	errBodyTooLarge    = errors.New("Signed request body is too large")
+)
+
+// principal is an authenticated caller and what it may access. Empty lists
+// allow any bucket or key.
+type principal struct {
+	Name        string   `json:"name"`
+	Buckets     []string `json:"buckets"`
+	KeyPrefixes []string `json:"key_prefixes"`
+	Admin       bool     `json:"admin"`
+}
+
+func (p *principal) allows(bucket string, key string) bool {
+	if p == nil {
+		return true
+	}
+	return (len(p.Buckets) == 0 || contains(p.Buckets, bucket)) &&
+		(len(p.KeyPrefixes) == 0 || hasAnyPrefix(strings.TrimPrefix(key, "/"), p.KeyPrefixes))
+}
+
+// allowsRequest reports whether p may read the source of req and write
+// every output it plans, wherever its key template puts them.
+func (p *principal) allowsRequest(req *requestPayload) bool {
+	if !p.allows(req.Bucket, req.Key) {
+		return false
+	}
+	bucket := req.Bucket
+	if req.DestinationBucket != "" {
+		bucket = req.DestinationBucket
+	}
+	for _, key := range req.plannedKeys() {
+		if !p.allows(bucket, key) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyPrefix(value string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(value, strings.TrimPrefix(prefix, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticator identifies the caller of r. It returns a nil principal and
+// nil error when r carries no credentials of its kind.
+type authenticator interface {
+	authenticate(r *http.Request) (*principal, error)
+}
+
+// authChain asks each authenticator in turn.
+type authChain []authenticator
+
+func (c authChain) authenticate(r *http.Request) (*principal, error) {
+	for _, a := range c {
+		p, err := a.authenticate(r)
+		if err != nil || p != nil {
+			return p, err
+		}
+	}
+	return nil, errUnauthenticated
+}
+
+type tokenConfig struct {
+	principal
+	Token string `json:"token"`
+}
+
+// tokenAuthenticator accepts static bearer tokens.
+type tokenAuthenticator map[string]*principal
+
+func (a tokenAuthenticator) authenticate(r *http.Request) (*principal, error) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return nil, nil
+	}
+	if p, ok := a[strings.TrimPrefix(h, "Bearer ")]; ok {
+		return p, nil
+	}
+	return nil, errUnauthenticated
+}
+
+type hmacKeyConfig struct {
+	principal
+	KeyID   string   `json:"key_id"`
+	Secrets []string `json:"secrets"`
+}
+
+type hmacKey struct {
+	principal *principal
+	secrets   [][]byte
+}
+
+// hmacAuthenticator accepts requests signed like callbacks, but over their
+// method and request URI as well as their body, naming the key in
+// keyIDHeader.
+type hmacAuthenticator struct {
+	keys      map[string]hmacKey
+	tolerance time.Duration
+	maxBody   int64
+}
+
+func (a *hmacAuthenticator) authenticate(r *http.Request) (*principal, error) {
+	id := r.Header.Get(keyIDHeader)
+	if id == "" {
+		return nil, nil
+	}
+	key, ok := a.keys[id]
+	if !ok {
+		return nil, errUnauthenticated
+	}
+	// The body is read whole to verify it, so cap it before anything is read.
+	r.Body = http.MaxBytesReader(nil, r.Body, a.maxBody)
+	if _, err := signature.VerifyAPIRequest(r, key.secrets, a.tolerance); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, errBodyTooLarge
+		}
+		return nil, errUnauthenticated
+	}
+	return key.principal, nil
+}
+
+// auth is nil when no credentials are configured, leaving the API open.
+var auth authenticator
+
+func readJSONFile(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func loadAuthenticator() (authenticator, error) {
+	var chain authChain
+	if path := os.Getenv("AUTH_TOKENS_PATH"); path != "" {
+		var configs []tokenConfig
+		if err := readJSONFile(path, &configs); err != nil {
+			return nil, err
+		}
+		a := tokenAuthenticator{}
+		for i := range configs {
+			a[configs[i].Token] = &configs[i].principal
+		}
+		chain = append(chain, a)
+	}
+	if path := os.Getenv("AUTH_HMAC_KEYS_PATH"); path != "" {
+		var configs []hmacKeyConfig
+		if err := readJSONFile(path, &configs); err != nil {
+			return nil, err
+		}
+		a := &hmacAuthenticator{
+			keys:      map[string]hmacKey{},
+			tolerance: time.Second * time.Duration(envInt("AUTH_HMAC_TOLERANCE_SECONDS", 300)),
+			maxBody:   int64(envInt("AUTH_HMAC_MAX_BODY_BYTES", 50<<20)),
+		}
+		for i, c := range configs {
+			key := hmacKey{principal: &configs[i].principal}
+			for _, s := range c.Secrets {
+				key.secrets = append(key.secrets, []byte(s))
+			}
+			a.keys[c.KeyID] = key
+		}
+		chain = append(chain, a)
+	}
+	if len(chain) == 0 {
+		return nil, nil
+	}
+	return chain, nil
+}
+
+type contextKey int
+
+const principalKey contextKey = 0
+
+func principalFrom(r *http.Request) *principal {
+	p, _ := r.Context().Value(principalKey).(*principal)
+	return p
+}
+
+// authenticated rejects requests without valid credentials before calling h
+// with the caller's principal in the request context.
+func authenticated(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if auth == nil {
+			h(w, r)
+			return
+		}
+		p, err := auth.authenticate(r)
+		if err == nil && p == nil {
+			err = errUnauthenticated
+		}
+		if err == errBodyTooLarge {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), principalKey, p)))
+	}
+}
+
+// adminOnly additionally requires an admin principal.
+func adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return authenticated(func(w http.ResponseWriter, r *http.Request) {
+		if p := principalFrom(r); p != nil && !p.Admin {
+			http.Error(w, errForbidden.Error(), http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ngs/docker-libreoffice-s3/signature"
+)
+
+func TestPrincipalAllows(t *testing.T) {
+	p := &principal{Buckets: []string{"my-bucket"}, KeyPrefixes: []string{"uploads/"}}
+	for _, test := range []struct {
+		expected bool
+		p        *principal
+		bucket   string
+		key      string
+	}{
+		{true, p, "my-bucket", "uploads/foo.pptx"},
+		{true, p, "my-bucket", "/uploads/foo.pptx"},
+		{false, p, "my-bucket", "private/foo.pptx"},
+		{false, p, "other-bucket", "uploads/foo.pptx"},
+		{true, &principal{}, "other-bucket", "private/foo.pptx"},
+		{true, nil, "other-bucket", "private/foo.pptx"},
+	} {
+		if actual := test.p.allows(test.bucket, test.key); actual != test.expected {
+			t.Errorf("Expected %v but got %v for %v/%v", test.expected, actual, test.bucket, test.key)
+		}
+	}
+}
+
+func TestPrincipalAllowsRequest(t *testing.T) {
+	p := &principal{Buckets: []string{"my-bucket", "cdn"}, KeyPrefixes: []string{"uploads/"}}
+	for _, test := range []struct {
+		expected bool
+		req      requestPayload
+	}{
+		{true, requestPayload{Bucket: "my-bucket", Key: "uploads/deck.pptx", Thumbnails: []thumbnailSpec{{Width: 200}}, ExtractText: "json"}},
+		{true, requestPayload{Bucket: "my-bucket", Key: "uploads/deck.pptx", DestinationBucket: "cdn", KeyTemplate: "uploads/{hash}/{name}.{ext}"}},
+		{true, requestPayload{Bucket: "my-bucket", Key: "uploads/deck.pptx", KeyTemplate: "{dir}/{job_id}.{ext}"}},
+		{false, requestPayload{Bucket: "my-bucket", Key: "uploads/deck.pptx", KeyTemplate: "private/{basename}.{ext}"}},
+		{false, requestPayload{Bucket: "my-bucket", Key: "uploads/deck.pptx", KeyTemplate: "{job_id}/uploads/{basename}.{ext}"}},
+		{false, requestPayload{Bucket: "my-bucket", Key: "uploads/deck.pptx", DestinationBucket: "other-bucket"}},
+	} {
+		if actual := p.allowsRequest(&test.req); actual != test.expected {
+			t.Errorf("Expected %v but got %v for %v", test.expected, actual, test.req.KeyTemplate)
+		}
+	}
+}
+
+func TestLoadAuthenticator(t *testing.T) {
+	tokens, _ := ioutil.TempFile("", "tokens")
+	defer os.Remove(tokens.Name())
+	tokens.WriteString(`[{"name":"uploader","token":"t0k3n","buckets":["my-bucket"]}]`)
+	tokens.Close()
+	keys, _ := ioutil.TempFile("", "keys")
+	defer os.Remove(keys.Name())
+	keys.WriteString(`[{"name":"api","key_id":"api","secrets":["s3cr3t"],"admin":true}]`)
+	keys.Close()
+	os.Setenv("AUTH_TOKENS_PATH", tokens.Name())
+	os.Setenv("AUTH_HMAC_KEYS_PATH", keys.Name())
+	os.Setenv("AUTH_HMAC_MAX_BODY_BYTES", "64")
+	defer os.Unsetenv("AUTH_TOKENS_PATH")
+	defer os.Unsetenv("AUTH_HMAC_KEYS_PATH")
+	defer os.Unsetenv("AUTH_HMAC_MAX_BODY_BYTES")
+	a, err := loadAuthenticator()
+	if err != nil {
+		t.Fatalf("Expected nil but got %v", err)
+	}
+
+	body := `{"bucket":"my-bucket","key":"foo.pptx"}`
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	bearer := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	bearer.Header.Set("Authorization", "Bearer t0k3n")
+	wrongBearer := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	wrongBearer.Header.Set("Authorization", "Bearer nope")
+	signed := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	signed.Header.Set(keyIDHeader, "api")
+	signed.Header.Set(signature.TimestampHeader, timestamp)
+	signed.Header.Set(signature.SignatureHeader, signature.Header([][]byte{[]byte("s3cr3t")}, timestamp, signature.RequestMessage("POST", "/", []byte(body))))
+	tampered := httptest.NewRequest("POST", "/", strings.NewReader(`{"bucket":"other-bucket"}`))
+	tampered.Header = signed.Header
+	replayed := httptest.NewRequest("POST", "/admin/dead-letters/replay?id=x", strings.NewReader(body))
+	replayed.Header = signed.Header
+	large := `{"bucket":"my-bucket","key":"` + strings.Repeat("a", 64) + `.pptx"}`
+	tooLarge := httptest.NewRequest("POST", "/", strings.NewReader(large))
+	tooLarge.Header.Set(keyIDHeader, "api")
+	tooLarge.Header.Set(signature.TimestampHeader, timestamp)
+	tooLarge.Header.Set(signature.SignatureHeader, signature.Header([][]byte{[]byte("s3cr3t")}, timestamp, signature.RequestMessage("POST", "/", []byte(large))))
+	anonymous := httptest.NewRequest("POST", "/", strings.NewReader(body))
+
+	for _, test := range []struct {
+		name string
+		err  error
+		r    *http.Request
+	}{
+		{"uploader", nil, bearer},
+		{"", errUnauthenticated, wrongBearer},
+		{"api", nil, signed},
+		{"", errUnauthenticated, tampered},
+		{"", errUnauthenticated, replayed},
+		{"", errBodyTooLarge, tooLarge},
+		{"", errUnauthenticated, anonymous},
+	} {
+		p, err := a.authenticate(test.r)
+		name := ""
+		if p != nil {
+			name = p.Name
+		}
+		if name != test.name || err != test.err {
+			t.Errorf("Expected %v %v but got %v %v", test.name, test.err, name, err)
+		}
+	}
+}
+
+func TestHandleConvertRequestForbidden(t *testing.T) {
+	orig := auth
+	defer func() { auth = orig }()
+	auth = tokenAuthenticator{"t0k3n": &principal{Buckets: []string{"my-bucket"}}}
+	handler := authenticated(handleConvertRequest)
+
+	for _, test := range []struct {
+		expected int
+		token    string
+	}{
+		{http.StatusUnauthorized, ""},
+		{http.StatusUnauthorized, "nope"},
+		{http.StatusForbidden, "t0k3n"},
+	} {
+		r := httptest.NewRequest("POST", "/", strings.NewReader(`{"bucket":"other-bucket","key":"foo.pptx"}`))
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != test.expected {
+			t.Errorf("Expected %v but got %v", test.expected, w.Code)
+		}
+	}
+}
+
+func TestHandleConvertRequestDotDotKey(t *testing.T) {
+	orig := auth
+	defer func() { auth = orig }()
+	auth = tokenAuthenticator{"t0k3n": &principal{KeyPrefixes: []string{"allowed/"}}}
+	root, _ := ioutil.TempDir("", "storage")
+	defer os.RemoveAll(root)
+	os.Setenv("STORAGE_FILE_ROOT", root)
+	defer os.Unsetenv("STORAGE_FILE_ROOT")
+
+	r := httptest.NewRequest("POST", "/", strings.NewReader(`{"source":"file:///allowed/../secret/x.docx"}`))
+	r.Header.Set("Authorization", "Bearer t0k3n")
+	w := httptest.NewRecorder()
+	authenticated(handleConvertRequest)(w, r)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), errKeyDotDot.Error()) {
+		t.Errorf("Expected %v %v but got %v %v", http.StatusBadRequest, errKeyDotDot, w.Code, w.Body.String())
+	}
+}
+
+func TestAdminOnly(t *testing.T) {
+	orig := auth
+	defer func() { auth = orig }()
+	auth = tokenAuthenticator{
+		"user":  &principal{},
+		"admin": &principal{Admin: true},
+	}
+	handler := adminOnly(func(w http.ResponseWriter, r *http.Request) {})
+	for _, test := range []struct {
+		expected int
+		token    string
+	}{
+		{http.StatusForbidden, "user"},
+		{http.StatusOK, "admin"},
+	} {
+		r := httptest.NewRequest("GET", "/admin/dead-letters", nil)
+		r.Header.Set("Authorization", "Bearer "+test.token)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != test.expected {
+			t.Errorf("Expected %v but got %v", test.expected, w.Code)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ngs/docker-libreoffice-s3/signature"
+)
+
+// callbackStatusError is returned when the receiver answers with a non-2xx
+// status.
+type callbackStatusError struct {
+	Status int
+	Body   string
+}
+
+func (e *callbackStatusError) Error() string {
+	return fmt.Sprintf("Error sending callback: %v %v", e.Status, e.Body)
+}
+
+// retryable reports whether another attempt may succeed. Network errors,
+// 5xx and 429 responses are retried; other statuses are final.
+func retryable(err error) bool {
+	serr, ok := err.(*callbackStatusError)
+	if !ok {
+		return true
+	}
+	return serr.Status >= 500 || serr.Status == http.StatusTooManyRequests
+}
+
+var callbackClient = &http.Client{
+	Timeout: time.Second * time.Duration(envInt("CALLBACK_TIMEOUT_SECONDS", 10)),
+}
+
+// callbackSecrets sign every callback. More than one secret may be active
+// while receivers rotate theirs.
+var callbackSecrets = parseSecrets(os.Getenv("CALLBACK_SIGNING_SECRETS"))
+
+func parseSecrets(value string) [][]byte {
+	var secrets [][]byte
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			secrets = append(secrets, []byte(s))
+		}
+	}
+	return secrets
+}
+
+// sendCallback makes a single delivery attempt.
+func sendCallback(method string, url string, json []byte) error {
+	if method == "" {
+		method = "POST"
+	}
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(json))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(callbackSecrets) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(signature.TimestampHeader, timestamp)
+		req.Header.Set(signature.SignatureHeader, signature.Header(callbackSecrets, timestamp, json))
+	}
+	res, err := callbackClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	status := res.StatusCode
+	if !(status >= 200 && status < 300) {
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+		return &callbackStatusError{Status: status, Body: string(body)}
+	}
+	return nil
+}
+
+type deadLetter struct {
+	ID       string          `json:"id"`
+	JobID    string          `json:"job_id,omitempty"`
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	FailedAt time.Time       `json:"failed_at"`
+}
+
+// deadLetterLog persists undeliverable callbacks as JSON lines.
+type deadLetterLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (l *deadLetterLog) append(d deadLetter) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, err := json.Marshal(&d)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+func (l *deadLetterLog) list() ([]deadLetter, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.read()
+}
+
+func (l *deadLetterLog) read() ([]deadLetter, error) {
+	result := []deadLetter{}
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var d deadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			continue
+		}
+		result = append(result, d)
+	}
+	return result, scanner.Err()
+}
+
+// update drops delivered entries and replaces retried ones. Entries appended
+// since the caller listed the log are preserved.
+func (l *deadLetterLog) update(delivered map[string]bool, retried map[string]deadLetter) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries, err := l.read()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, d := range entries {
+		if delivered[d.ID] {
+			continue
+		}
+		if r, ok := retried[d.ID]; ok {
+			d = r
+		}
+		b, err := json.Marshal(&d)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(b, '\n'))
+	}
+	tmp := l.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
+
+// callbackDeliverer retries callbacks with exponential backoff and jitter and
+// records the ones it gives up on in the dead-letter log.
+type callbackDeliverer struct {
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	deadLetters *deadLetterLog
+	replaying   sync.Mutex
+}
+
+var callbacks = &callbackDeliverer{
+	maxAttempts: envInt("CALLBACK_MAX_ATTEMPTS", 5),
+	baseDelay:   time.Second * time.Duration(envInt("CALLBACK_BACKOFF_SECONDS", 1)),
+	maxDelay:    time.Second * time.Duration(envInt("CALLBACK_BACKOFF_MAX_SECONDS", 60)),
+	deadLetters: &deadLetterLog{path: deadLetterPath()},
+}
+
+func deadLetterPath() string {
+	if path := os.Getenv("CALLBACK_DEAD_LETTER_PATH"); path != "" {
+		return path
+	}
+	return filepath.Join(os.TempDir(), "convserver-dead-letters.jsonl")
+}
+
+func (d *callbackDeliverer) backoff(attempt int) time.Duration {
+	delay := d.baseDelay << uint(attempt-1)
+	if delay > d.maxDelay || delay <= 0 {
+		delay = d.maxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// attempt sends the callback until it succeeds, fails permanently or runs
+// out of attempts. It returns the number of attempts made.
+func (d *callbackDeliverer) attempt(method string, url string, body []byte) (int, error) {
+	var err error
+	attempts := 0
+	for attempts < d.maxAttempts || attempts == 0 {
+		// Aborted jobs get one attempt so shutdown is not held up.
+		if attempts > 0 && aborted() {
+			break
+		}
+		if attempts > 0 {
+			time.Sleep(d.backoff(attempts))
+		}
+		attempts++
+		err = sendCallback(method, url, body)
+		if err == nil || !retryable(err) {
+			break
+		}
+	}
+	return attempts, err
+}
+
+func (d *callbackDeliverer) deliver(jobID string, method string, url string, body []byte) error {
+	attempts, err := d.attempt(method, url, body)
+	if err == nil {
+		return nil
+	}
+	d.deadLetters.append(deadLetter{
+		ID:       newJobID(),
+		JobID:    jobID,
+		Method:   method,
+		URL:      url,
+		Body:     json.RawMessage(body),
+		Attempts: attempts,
+		Error:    err.Error(),
+		FailedAt: time.Now().UTC(),
+	})
+	return err
+}
+
+type replayResult struct {
+	Delivered []string     `json:"delivered"`
+	Failed    []deadLetter `json:"failed"`
+}
+
+// pending lists the dead letters to replay, all of them when ids is empty.
+func (d *callbackDeliverer) pending(ids []string) ([]deadLetter, error) {
+	entries, err := d.deadLetters.list()
+	if err != nil || len(ids) == 0 {
+		return entries, err
+	}
+	selected := map[string]bool{}
+	for _, id := range ids {
+		selected[id] = true
+	}
+	result := []deadLetter{}
+	for _, e := range entries {
+		if selected[e.ID] {
+			result = append(result, e)
+		}
+	}
+	return result, nil
+}
+
+// replay redelivers dead letters, all of them when ids is empty.
+func (d *callbackDeliverer) replay(ids []string) (replayResult, error) {
+	result := replayResult{Delivered: []string{}, Failed: []deadLetter{}}
+	entries, err := d.pending(ids)
+	if err != nil {
+		return result, err
+	}
+	delivered := map[string]bool{}
+	retried := map[string]deadLetter{}
+	for _, e := range entries {
+		attempts, err := d.attempt(e.Method, e.URL, e.Body)
+		if err == nil {
+			delivered[e.ID] = true
+			result.Delivered = append(result.Delivered, e.ID)
+			continue
+		}
+		e.Attempts += attempts
+		e.Error = err.Error()
+		e.FailedAt = time.Now().UTC()
+		retried[e.ID] = e
+		result.Failed = append(result.Failed, e)
+	}
+	return result, d.deadLetters.update(delivered, retried)
+}
+
+func handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "We don't accept "+r.Method+" requests", http.StatusMethodNotAllowed)
+		return
+	}
+	entries, err := callbacks.deadLetters.list()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+type replayAccepted struct {
+	Replaying []string `json:"replaying"`
+}
+
+// handleDeadLettersReplay redelivers dead letters in the background, since
+// each one may go through the whole backoff schedule. Progress shows in the
+// dead-letter list.
+func handleDeadLettersReplay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "We don't accept "+r.Method+" requests", http.StatusMethodNotAllowed)
+		return
+	}
+	if !callbacks.replaying.TryLock() {
+		http.Error(w, "Dead letters are already being replayed", http.StatusConflict)
+		return
+	}
+	ids := r.URL.Query()["id"]
+	entries, err := callbacks.pending(ids)
+	if err != nil {
+		callbacks.replaying.Unlock()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res := replayAccepted{Replaying: []string{}}
+	for _, e := range entries {
+		res.Replaying = append(res.Replaying, e.ID)
+	}
+	go func(d *callbackDeliverer) {
+		defer d.replaying.Unlock()
+		result, err := d.replay(ids)
+		if err != nil {
+			log.Printf("Failed to replay dead letters: %v", err)
+			return
+		}
+		log.Printf("Replayed dead letters: %d delivered, %d failed", len(result.Delivered), len(result.Failed))
+	}(callbacks)
+	writeJSON(w, http.StatusAccepted, res)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ngs/docker-libreoffice-s3/signature"
+	gock "gopkg.in/h2non/gock.v1"
+)
+
+func testDeliverer(t *testing.T) *callbackDeliverer {
+	f, err := ioutil.TempFile("", "dead-letters")
+	if err != nil {
+		t.Fatalf("Failed to create dead-letter file %v", err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return &callbackDeliverer{
+		maxAttempts: 3,
+		deadLetters: &deadLetterLog{path: f.Name()},
+	}
+}
+
+// useTestDeliverer swaps the global deliverer for one without backoff and
+// returns a function restoring it.
+func useTestDeliverer(t *testing.T) func() {
+	orig := callbacks
+	callbacks = testDeliverer(t)
+	return func() {
+		os.Remove(callbacks.deadLetters.path)
+		callbacks = orig
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	for _, test := range []struct {
+		expected bool
+		err      error
+	}{
+		{true, errors.New("connection refused")},
+		{true, &callbackStatusError{Status: 502}},
+		{true, &callbackStatusError{Status: 429}},
+		{false, &callbackStatusError{Status: 404}},
+	} {
+		if actual := retryable(test.err); actual != test.expected {
+			t.Errorf("Expected %v but got %v for %v", test.expected, actual, test.err)
+		}
+	}
+}
+
+func TestSendCallbackSigned(t *testing.T) {
+	orig := callbackSecrets
+	defer func() { callbackSecrets = orig }()
+	callbackSecrets = parseSecrets("new, old")
+	defer gock.Off()
+	verified := errors.New("Callback was not sent")
+	gock.New("http://foo-internal-api.bar.baz").
+		Post("/path/to/callback").
+		AddMatcher(func(r *http.Request, _ *gock.Request) (bool, error) {
+			_, verified = signature.VerifyRequest(r, [][]byte{[]byte("old")}, time.Minute)
+			return true, nil
+		}).
+		Reply(200)
+	err := sendCallback("", "http://foo-internal-api.bar.baz/path/to/callback", []byte(`{"status":"ok"}`))
+	for _, test := range []struct {
+		expected interface{}
+		actual   interface{}
+	}{
+		{nil, err},
+		{nil, verified},
+	} {
+		if test.expected != test.actual {
+			t.Errorf("Expected %v but got %v", test.expected, test.actual)
+		}
+	}
+}
+
+func TestCallbackDelivererRetries(t *testing.T) {
+	d := testDeliverer(t)
+	defer os.Remove(d.deadLetters.path)
+	defer gock.Off()
+	gock.New("http://foo-internal-api.bar.baz").
+		Post("/path/to/callback").
+		Reply(503)
+	gock.New("http://foo-internal-api.bar.baz").
+		Post("/path/to/callback").
+		Reply(200)
+	err := d.deliver("job", "", "http://foo-internal-api.bar.baz/path/to/callback", []byte(`{"status":"ok"}`))
+	entries, _ := d.deadLetters.list()
+	for _, test := range []struct {
+		expected interface{}
+		actual   interface{}
+	}{
+		{nil, err},
+		{true, gock.IsDone()},
+		{0, len(entries)},
+	} {
+		if test.expected != test.actual {
+			t.Errorf("Expected %v but got %v", test.expected, test.actual)
+		}
+	}
+}
+
+func TestHandleDeadLettersReplay(t *testing.T) {
+	defer useTestDeliverer(t)()
+	callbacks.deadLetters.append(deadLetter{ID: "letter", Method: "PUT", URL: "http://foo-internal-api.bar.baz/path/to/callback", Body: []byte(`{}`)})
+	defer gock.Off()
+	gock.New("http://foo-internal-api.bar.baz").
+		Put("/path/to/callback").
+		Reply(204)
+
+	w := httptest.NewRecorder()
+	handleDeadLettersReplay(w, httptest.NewRequest("POST", "/admin/dead-letters/replay", nil))
+	var res replayAccepted
+	json.NewDecoder(w.Body).Decode(&res)
+	entries, _ := callbacks.deadLetters.list()
+	for i := 0; i < 100 && len(entries) > 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+		entries, _ = callbacks.deadLetters.list()
+	}
+	for _, test := range []struct {
+		expected interface{}
+		actual   interface{}
+	}{
+		{http.StatusAccepted, w.Code},
+		{1, len(res.Replaying)},
+		{0, len(entries)},
+	} {
+		if test.expected != test.actual {
+			t.Errorf("Expected %v but got %v", test.expected, test.actual)
+		}
+	}
+}
+
+func TestCallbackDelivererDeadLetter(t *testing.T) {
+	d := testDeliverer(t)
+	defer os.Remove(d.deadLetters.path)
+	defer gock.Off()
+	gock.New("http://foo-internal-api.bar.baz").
+		Put("/path/to/callback").
+		Times(3).
+		Reply(500).
+		BodyString("Oh")
+	err := d.deliver("job", "PUT", "http://foo-internal-api.bar.baz/path/to/callback", []byte(`{"status":"ok"}`))
+	entries, _ := d.deadLetters.list()
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 but got %v", len(entries))
+	}
+	for _, test := range []struct {
+		expected interface{}
+		actual   interface{}
+	}{
+		{"Error sending callback: 500 Oh", err.Error()},
+		{"job", entries[0].JobID},
+		{3, entries[0].Attempts},
+		{`{"status":"ok"}`, string(entries[0].Body)},
+	} {
+		if test.expected != test.actual {
+			t.Errorf("Expected %v but got %v", test.expected, test.actual)
+		}
+	}
+
+	gock.New("http://foo-internal-api.bar.baz").
+		Put("/path/to/callback").
+		Reply(204)
+	result, err := d.replay(nil)
+	entries, _ = d.deadLetters.list()
+	for _, test := range []struct {
+		expected interface{}
+		actual   interface{}
+	}{
+		{nil, err},
+		{1, len(result.Delivered)},
+		{0, len(result.Failed)},
+		{0, len(entries)},
+	} {
+		if test.expected != test.actual {
+			t.Errorf("Expected %v but got %v", test.expected, test.actual)
+		}
+	}
+}
@@ -1,11 +1,10 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -14,41 +13,96 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	bugsnag "github.com/bugsnag/bugsnag-go"
 )
 
-var pdfInfoRegexp = regexp.MustCompile("Page size:\\s+(\\d+) x (\\d+) pts")
+// Error codes reported in failure callbacks.
+const (
+	codeDownloadFailed       = "download_failed"
+	codeConversionTimeout    = "conversion_timeout"
+	codeConversionFailed     = "conversion_failed"
+	codeUploadFailed         = "upload_failed"
+	codeMetadataFailed       = "metadata_failed"
+	codeThumbnailFailed      = "thumbnail_failed"
+	codeTextExtractionFailed = "text_extraction_failed"
+	codeAborted              = "aborted"
+	codeInternalError        = "internal_error"
+)
+
+// conversionError tags an error from runCommand with the code reported to
+// the callback receiver.
+type conversionError struct {
+	Code string
+	Err  error
+}
+
+func (e *conversionError) Error() string {
+	return e.Err.Error()
+}
 
 type requestPayload struct {
-	Bucket             string `json:"bucket"`
-	Key                string `json:"key"`
-	CallbackURL        string `json:"callback_url"`
-	CallbackHTTPMethod string `json:"callback_method,omitempty"`
+	Bucket             string            `json:"bucket"`
+	Key                string            `json:"key"`
+	Source             string            `json:"source,omitempty"`
+	DestinationBucket  string            `json:"destination_bucket,omitempty"`
+	KeyTemplate        string            `json:"key_template,omitempty"`
+	CallbackURL        string            `json:"callback_url"`
+	CallbackHTTPMethod string            `json:"callback_method,omitempty"`
+	Outputs            []string          `json:"outputs,omitempty"`
+	Thumbnails         []thumbnailSpec   `json:"thumbnails,omitempty"`
+	DocumentType       string            `json:"document_type,omitempty"`
+	Filters            map[string]string `json:"filters,omitempty"`
+	PDFOptions         *pdfOptions       `json:"pdf_options,omitempty"`
+	Archival           bool              `json:"archival,omitempty"`
+	ExtractText        string            `json:"extract_text,omitempty"`
+}
+
+type acceptedResponse struct {
+	job
+	Queue queueStatus `json:"queue"`
+}
+
+type errorResponse struct {
+	Error string      `json:"error"`
+	Queue queueStatus `json:"queue"`
 }
 
 type responsePayload struct {
 	Status     string                    `json:"status"`
-	Thumbnails thumbnailsResponsePayload `json:"thumbnails"`
+	Thumbnails thumbnailsResponsePayload `json:"thumbnails,omitempty"`
+	Error      *errorPayload             `json:"error,omitempty"`
 }
-type thumbnailsResponsePayload struct {
-	Preview fileResponsePayload `json:"preview"`
+
+type errorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
+// thumbnailsResponsePayload maps output names, "preview" for the PDF, to the
+// files produced.
+type thumbnailsResponsePayload map[string]fileResponsePayload
+
 type fileResponsePayload struct {
+	Key         string `json:"key,omitempty"`
 	ContentHash string `json:"content_hash"`
 	ContentType string `json:"content_type"`
 	ContentSize int    `json:"content_size"`
-	Width       int    `json:"width"`
-	Height      int    `json:"height"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	Page        int    `json:"page,omitempty"`
+	// PDFs also describe every page and the document they came from.
+	PageCount  int                 `json:"page_count,omitempty"`
+	Pages      []pdfPage           `json:"pages,omitempty"`
+	PDFVersion string              `json:"pdf_version,omitempty"`
+	Properties *documentProperties `json:"properties,omitempty"`
+	// Conformance and Validation are set on archival renditions.
+	Conformance string          `json:"conformance,omitempty"`
+	Validation  *pdfaValidation `json:"validation,omitempty"`
 }
 
 func main() {
@@ -63,28 +117,172 @@ func main() {
 			ReleaseStage: releaseStage,
 		})
 	}
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != "POST" {
-			http.Error(w, "We don't accept "+r.Method+" requests", http.StatusBadRequest)
-			return
+	var err error
+	if auth, err = loadAuthenticator(); err != nil {
+		log.Fatal(err)
+	}
+	if s3EventRoutes, err = loadS3EventRoutes(); err != nil {
+		log.Fatal(err)
+	}
+	if err := profiles.prepare(); err != nil {
+		log.Printf("Failed to prepare LibreOffice profile template: %v", err)
+	}
+	startReaper(time.Second * time.Duration(envInt("OFFICE_REAPER_INTERVAL_SECONDS", 60)))
+	if size := envInt("OFFICE_POOL_SIZE", 0); size > 0 {
+		if offices, err = newOfficePool(size, envInt("OFFICE_BASE_PORT", 2002)); err != nil {
+			log.Fatal(err)
 		}
-		var req requestPayload
-		decoder := json.NewDecoder(r.Body)
-		if err := decoder.Decode(&req); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+	}
+	if path := os.Getenv("JOB_STORE_PATH"); path != "" {
+		unfinished, err := jobs.open(path)
+		if err != nil {
+			log.Fatal(err)
 		}
-		defer r.Body.Close()
-		go runCommand(req)
-		fmt.Fprintf(w, "OK")
-	})
+		go resumeJobs(unfinished)
+	}
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
+	http.HandleFunc("/selftest", authenticated(handleSelfTest))
+	http.HandleFunc("/", authenticated(handleConvertRequest))
+	http.HandleFunc("/convert", authenticated(handleSyncConvert))
+	http.HandleFunc("/jobs", authenticated(handleJobs))
+	http.HandleFunc("/jobs/", authenticated(handleJob))
+	http.HandleFunc("/s3-events", authenticated(handleS3Events))
+	http.HandleFunc("/s3-events/sns", handleSNS)
+	http.HandleFunc("/admin/dead-letters", adminOnly(handleDeadLetters))
+	http.HandleFunc("/admin/dead-letters/replay", adminOnly(handleDeadLettersReplay))
+	stop := make(chan struct{})
+	if queueURL := os.Getenv("SQS_QUEUE_URL"); queueURL != "" {
+		go newSQSConsumer(queueURL).consume(stop)
+	}
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
-	err := http.ListenAndServe(":"+port, nil)
-	bugsnag.Notify(err)
-	log.Fatal(err)
+	if err := serve(&http.Server{Addr: ":" + port}, stop); err != nil {
+		bugsnag.Notify(err)
+		log.Fatal(err)
+	}
+}
+
+func envInt(name string, defaultValue int) int {
+	v, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return defaultValue
+	}
+	return v
+}
+
+func envString(name string, defaultValue string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return defaultValue
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func handleConvertRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "We don't accept "+r.Method+" requests", http.StatusBadRequest)
+		return
+	}
+	var req requestPayload
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+	if err := validateRequest(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p := principalFrom(r)
+	if !p.allowsRequest(&req) {
+		http.Error(w, errForbidden.Error(), http.StatusForbidden)
+		return
+	}
+	j, err := queueJob(req)
+	status := workers.status()
+	w.Header().Set("X-Queue-Depth", strconv.Itoa(status.Depth))
+	if err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(envInt("QUEUE_RETRY_AFTER_SECONDS", 30)))
+		writeJSON(w, http.StatusServiceUnavailable, errorResponse{Error: err.Error(), Queue: status})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, acceptedResponse{job: j, Queue: status})
+}
+
+// queueJob records a job for req and hands it to the workers, forgetting it
+// again when the queue is full.
+func queueJob(req requestPayload) (job, error) {
+	j, err := jobs.accept(req)
+	if err != nil {
+		return job{}, err
+	}
+	if err := workers.submit(func() { runCommand(j.ID, req) }); err != nil {
+		jobs.remove(j.ID)
+		return job{}, err
+	}
+	return j, nil
+}
+
+func validateRequest(req *requestPayload) error {
+	if err := validateSource(req); err != nil {
+		return err
+	}
+	if err := validateOutputs(req.Outputs); err != nil {
+		return err
+	}
+	if err := validateFamily(req); err != nil {
+		return err
+	}
+	if err := validatePDFOptions(req.PDFOptions, req.outputs()); err != nil {
+		return err
+	}
+	if err := validateArchival(req); err != nil {
+		return err
+	}
+	if err := validateExtractText(req); err != nil {
+		return err
+	}
+	if err := validateDestination(req); err != nil {
+		return err
+	}
+	return validateThumbnails(req.Thumbnails, req.outputs())
+}
+
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "We don't accept "+r.Method+" requests", http.StatusMethodNotAllowed)
+		return
+	}
+	p := principalFrom(r)
+	result := []job{}
+	for _, j := range jobs.list(jobState(r.URL.Query().Get("state"))) {
+		if p.allows(j.Request.Bucket, j.Request.Key) {
+			result = append(result, j)
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "We don't accept "+r.Method+" requests", http.StatusMethodNotAllowed)
+		return
+	}
+	j, ok := jobs.get(strings.TrimPrefix(r.URL.Path, "/jobs/"))
+	if !ok || !principalFrom(r).allows(j.Request.Bucket, j.Request.Key) {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, j)
 }
 
 func convertPreiviewKey(orgKey string) string {
@@ -113,10 +311,20 @@ func computeMd5(filePath string) ([]byte, error) {
 	return hash.Sum(result), nil
 }
 
-func responseJSONFromFile(file *os.File) ([]byte, error) {
+// pendingOutput is a converted or rendered file waiting to be uploaded.
+type pendingOutput struct {
+	Name   string
+	Path   string
+	Key    string
+	Format outputFormat
+	Page   int
+}
+
+func filePayloadFromFile(file *os.File, format outputFormat) (fileResponsePayload, error) {
+	var payload fileResponsePayload
 	hashBytes, err := computeMd5(file.Name())
 	if err != nil {
-		return []byte{}, err
+		return payload, err
 	}
 	hash := hex.EncodeToString(hashBytes)
 	if hash == "" {
@@ -124,170 +332,263 @@ func responseJSONFromFile(file *os.File) ([]byte, error) {
 	}
 	fi, err := file.Stat()
 	if err != nil {
-		return []byte{}, err
+		return payload, err
 	}
-	size := int(fi.Size())
-	w, h, err := pdfSize(file.Name())
-	if err != nil {
-		return []byte{}, err
-	}
-	payload := responsePayload{
-		Status: "completed",
-		Thumbnails: thumbnailsResponsePayload{
-			Preview: fileResponsePayload{
-				ContentType: "application/pdf",
-				ContentHash: hash,
-				ContentSize: size,
-				Width:       w,
-				Height:      h,
-			},
-		},
+	payload = fileResponsePayload{
+		ContentType: format.ContentType,
+		ContentHash: hash,
+		ContentSize: int(fi.Size()),
 	}
-	b, err := json.Marshal(&payload)
-	if err != nil {
-		return []byte{}, err
+	switch format.Name {
+	case "pdf":
+		var info pdfInfo
+		if info, err = inspectPDF(file.Name()); err != nil {
+			return payload, err
+		}
+		payload.Width, payload.Height, err = info.size()
+		payload.PageCount = info.PageCount
+		payload.Pages = info.Pages
+		payload.PDFVersion = info.Version
+		payload.Properties = pdfProperties(info)
+	case "png", "jpeg":
+		payload.Width, payload.Height, err = imageSize(file.Name())
+	case "webp":
+		payload.Width, payload.Height, err = webpSize(file.Name())
 	}
-	return b, nil
+	return payload, err
 }
 
-func runWriter(filename string) error {
-	cmd := exec.Command("lowriter",
-		"--invisible",
-		"--convert-to",
-		"pdf:writer_pdf_Export",
-		"--outdir",
-		filepath.Dir(filename),
-		filename)
-	err := cmd.Start()
+// previewPayloadFromFile describes the preview PDF, preferring the source
+// document's own properties to those LibreOffice copied into the PDF.
+func previewPayloadFromFile(file *os.File, source string) (fileResponsePayload, error) {
+	payload, err := filePayloadFromFile(file, outputFormats["pdf"])
 	if err != nil {
-		return err
+		return payload, err
 	}
-	timeoutSeconds, err := strconv.Atoi(os.Getenv("CMD_TIMEOUT_SECONDS"))
-	if err != nil {
-		timeoutSeconds = 60
+	if p := sourceProperties(source); p != nil {
+		payload.Properties = p
 	}
-	timer := time.AfterFunc(time.Second*time.Duration(timeoutSeconds), func() {
-		cmd.Process.Kill()
-	})
-	err = cmd.Wait()
-	timer.Stop()
-	return err
+	return payload, nil
 }
 
-func pdfSize(filename string) (int, int, error) {
-	bin := os.Getenv("PDF_INFO_PATH")
-	if bin == "" {
-		bin = "pdfinfo"
-	}
-	cmd := exec.Command(bin, filename)
-
-	out, err := cmd.Output()
-	if err != nil {
-		return 0, 0, err
-	}
-	m := pdfInfoRegexp.FindAllStringSubmatch(string(out), 1)
-	if len(m) == 0 {
-		return 0, 0, errors.New("Invalid pdfinfo output")
-	}
-	line := m[0]
-	w, _ := strconv.Atoi(line[1])
-	h, _ := strconv.Atoi(line[2])
-	return w, h, nil
+func failureJSON(err *conversionError) ([]byte, error) {
+	return json.Marshal(&responsePayload{
+		Status: "failed",
+		Error: &errorPayload{
+			Code:    err.Code,
+			Message: err.Error(),
+		},
+	})
 }
 
-func sendCallback(method string, url string, json []byte) error {
-	if method == "" {
-		method = "POST"
+func runWriter(ctx context.Context, filename string, c conversion) error {
+	if offices != nil {
+		if err := offices.convert(ctx, filename, c); err != errOfficeUnavailable {
+			return err
+		}
 	}
-	req, err := http.NewRequest(method, url, bytes.NewBuffer(json))
+	profile, err := profiles.create()
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	res, err := client.Do(req)
-	status := res.StatusCode
-	if !(status >= 200 && status < 300) {
-		body, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			return err
-		}
-		return fmt.Errorf("Error sending callback: %v %v", status, string(body))
-	}
-	return err
+	defer profiles.release(profile)
+	cmd := exec.Command(envString("SOFFICE_PATH", "soffice"),
+		"--headless",
+		"--invisible",
+		c.Family.Module,
+		profileArg(profile),
+		"--convert-to",
+		c.target(),
+		"--outdir",
+		c.outdir(filename),
+		filename)
+	return runWithTimeout(ctx, cmd)
 }
 
-func runCommand(req requestPayload) error {
-	defer bugsnag.Recover()
+func runCommand(id string, req requestPayload) (err error) {
 	bugsnagMetadata := bugsnag.MetaData{
 		"req": {
+			"JobID":              id,
 			"Bucket":             req.Bucket,
 			"Key":                req.Key,
 			"CallbackURL":        req.CallbackURL,
 			"CallbackHTTPMethod": req.CallbackHTTPMethod,
 		},
 	}
-	tmpfile, err := ioutil.TempFile("", strings.Replace(req.Key, "/", "_", -1))
-	if err != nil {
+	fail := func(code string, err error) error {
+		if aborted() {
+			code, err = codeAborted, errJobAborted
+		}
+		cerr := &conversionError{Code: code, Err: err}
 		bugsnag.Notify(err, bugsnagMetadata)
-		return err
+		jobs.transition(id, jobFailed, cerr)
+		json, err := failureJSON(cerr)
+		if err == nil {
+			err = callbacks.deliver(id, req.CallbackHTTPMethod, req.CallbackURL, json)
+		}
+		if err != nil {
+			bugsnag.Notify(err, bugsnagMetadata)
+		}
+		return cerr
 	}
-
+	// A panic fails the job like any other error, so the caller sees it and
+	// the callback still goes out.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fail(codeInternalError, fmt.Errorf("Conversion panicked: %v", r))
+		}
+	}()
+	if aborted() {
+		// Jobs in the store stay queued there and resume on the next start.
+		if jobs.persisted(id) {
+			return errJobAborted
+		}
+		return fail(codeAborted, errJobAborted)
+	}
+	jobs.transition(id, jobDownloading, nil)
+	// Outputs are named after the source key, so each job converts in a
+	// directory of its own.
+	workdir, err := ioutil.TempDir("", "convert")
 	if err != nil {
-		bugsnag.Notify(err, bugsnagMetadata)
-		return err
+		return fail(codeDownloadFailed, err)
+	}
+	defer os.RemoveAll(workdir)
+	tmpfile, err := ioutil.TempFile(workdir, strings.Replace(req.Key, "/", "_", -1))
+	if err != nil {
+		return fail(codeDownloadFailed, err)
 	}
 
-	sess := session.New()
-	dl := s3manager.NewDownloader(sess)
-	fs, err := os.Create(tmpfile.Name())
+	store, err := req.storage()
 	if err != nil {
-		bugsnag.Notify(err, bugsnagMetadata)
-		return err
+		return fail(codeDownloadFailed, err)
 	}
-	_, err = dl.Download(fs, &s3.GetObjectInput{
-		Bucket: &req.Bucket,
-		Key:    &req.Key,
-	})
+	err = download(store, req.Key, tmpfile)
+	tmpfile.Close()
 	if err != nil {
-		bugsnag.Notify(err, bugsnagMetadata)
-		return err
+		return fail(codeDownloadFailed, err)
 	}
-	defer os.Remove(tmpfile.Name())
 
-	err = runWriter(tmpfile.Name())
-	if err != nil {
-		bugsnag.Notify(err, bugsnagMetadata)
-		return err
+	jobs.transition(id, jobConverting, nil)
+	var outputs []pendingOutput
+	for _, name := range req.outputs() {
+		format := outputFormats[name]
+		err = runWriter(jobContext, tmpfile.Name(), req.conversion(format))
+		if isTimeout(err) {
+			return fail(codeConversionTimeout, err)
+		}
+		if err != nil {
+			return fail(codeConversionFailed, err)
+		}
+		outputs = append(outputs, pendingOutput{
+			Name:   outputName(format),
+			Path:   outputPath(tmpfile.Name(), format),
+			Key:    convertOutputKey(req.Key, format),
+			Format: format,
+		})
 	}
 
-	pdf, err := os.Open(strings.TrimSuffix(tmpfile.Name(), filepath.Ext(tmpfile.Name())) + ".pdf")
+	if len(req.Thumbnails) > 0 {
+		dir, err := ioutil.TempDir("", "thumbnails")
+		if err != nil {
+			return fail(codeThumbnailFailed, err)
+		}
+		defer os.RemoveAll(dir)
+		for _, spec := range req.Thumbnails {
+			pages, err := renderThumbnails(jobContext, outputPath(tmpfile.Name(), outputFormats["pdf"]), dir, spec)
+			if err != nil {
+				return fail(codeThumbnailFailed, err)
+			}
+			for _, page := range pages {
+				outputs = append(outputs, pendingOutput{
+					Name:   thumbnailName(spec, page.Page),
+					Path:   page.Path,
+					Key:    convertThumbnailKey(req.Key, spec, page.Page),
+					Format: spec.format(),
+					Page:   page.Page,
+				})
+			}
+		}
+	}
+
+	if req.ExtractText != "" {
+		fromPDF := contains(req.outputs(), "pdf")
+		if txt := outputFormats["txt"]; !fromPDF && !contains(req.outputs(), "txt") {
+			err = runWriter(jobContext, tmpfile.Name(), req.conversion(txt))
+			if isTimeout(err) {
+				return fail(codeConversionTimeout, err)
+			}
+			if err != nil {
+				return fail(codeTextExtractionFailed, err)
+			}
+		}
+		pages, err := extractText(jobContext, tmpfile.Name(), fromPDF)
+		if err != nil {
+			return fail(codeTextExtractionFailed, err)
+		}
+		format := textFormats[req.ExtractText]
+		path := tmpfile.Name() + "-text." + format.Extension
+		if err := writeText(pages, path, format); err != nil {
+			return fail(codeTextExtractionFailed, err)
+		}
+		outputs = append(outputs, pendingOutput{
+			Name:   "text",
+			Path:   path,
+			Key:    convertTextKey(req.Key, format),
+			Format: format,
+		})
+	}
+
+	jobs.transition(id, jobUploading, nil)
+	dest, err := req.destination(store)
 	if err != nil {
-		bugsnag.Notify(err, bugsnagMetadata)
-		return err
+		return fail(codeUploadFailed, err)
 	}
-	defer pdf.Close()
+	thumbnails := thumbnailsResponsePayload{}
+	for _, output := range outputs {
+		out, err := os.Open(output.Path)
+		if err != nil {
+			return fail(codeConversionFailed, err)
+		}
+		defer out.Close()
+
+		var payload fileResponsePayload
+		if output.Format.Name == "pdf" {
+			payload, err = previewPayloadFromFile(out, tmpfile.Name())
+		} else {
+			payload, err = filePayloadFromFile(out, output.Format)
+		}
+		if err != nil {
+			return fail(codeMetadataFailed, err)
+		}
 
-	destKey := convertPreiviewKey(req.Key)
-	contentType := "application/pdf"
+		output.Key = req.outputKey(id, output, payload.ContentHash)
+		if err := dest.Put(output.Key, out, output.Format.ContentType); err != nil {
+			return fail(codeUploadFailed, err)
+		}
+		payload.Key = output.Key
+		if req.Archival && output.Format.Name == "pdf" {
+			validation := validatePDFA(jobContext, output.Path, archivalConformance)
+			payload.Conformance = "PDF/A-" + archivalConformance
+			payload.Validation = &validation
+		}
+		payload.Page = output.Page
+		thumbnails[output.Name] = payload
+	}
 
-	ul := s3manager.NewUploader(sess)
-	_, err = ul.Upload(&s3manager.UploadInput{
-		Bucket:      &req.Bucket,
-		Key:         &destKey,
-		Body:        pdf,
-		ContentType: &contentType,
+	body, err := json.Marshal(&responsePayload{
+		Status:     "completed",
+		Thumbnails: thumbnails,
 	})
-
-	json, err := responseJSONFromFile(pdf)
 	if err != nil {
-		bugsnag.Notify(err, bugsnagMetadata)
-		return err
+		return fail(codeMetadataFailed, err)
 	}
-	err = sendCallback(req.CallbackHTTPMethod, req.CallbackURL, json)
+	jobs.transition(id, jobCallingBack, nil)
+	err = callbacks.deliver(id, req.CallbackHTTPMethod, req.CallbackURL, body)
 	if err != nil {
 		bugsnag.Notify(err, bugsnagMetadata)
+		jobs.transition(id, jobFailed, err)
 		return err
 	}
+	jobs.transition(id, jobCompleted, nil)
 	return nil
 }
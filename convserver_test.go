@@ -1,10 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	gock "gopkg.in/h2non/gock.v1"
 )
@@ -25,30 +27,31 @@ func TestConvertPreiviewKey2(t *testing.T) {
 	}
 }
 
-func TestResponseJSONFromFile(t *testing.T) {
+func TestPreviewPayloadFromFile(t *testing.T) {
 	os.Setenv("PDF_INFO_PATH", "mock-commands/pdfinfo")
 	file, err := os.Open(".gitignore")
 	if err != nil {
 		t.Errorf("Failed to open test file %v", err)
 	}
-	json, _ := responseJSONFromFile(file)
-	actual := string(json)
-	expected := `{"status":"completed","thumbnails":{"preview":{"content_hash":"b0214b0ba0fa51ebf8bd66ba20a82ee9","content_type":"application/pdf","content_size":24,"width":842,"height":595}}}`
+	payload, _ := previewPayloadFromFile(file, "")
+	b, _ := json.Marshal(&payload)
+	actual := string(b)
+	expected := `{"content_hash":"b0214b0ba0fa51ebf8bd66ba20a82ee9","content_type":"application/pdf","content_size":24,"width":842,"height":595,"page_count":15,"pages":[{"width":842,"height":595,"rotation":0}],"pdf_version":"1.4","properties":{"author":"sata","application":"Calc"}}`
 	if actual != expected {
 		t.Errorf("Expected %v but got %v", expected, actual)
 	}
 }
 
-func TestResponseJSONFromFileError(t *testing.T) {
+func TestPreviewPayloadFromFileError(t *testing.T) {
 	file, _ := ioutil.TempFile("", "fail")
 	os.Remove(file.Name())
-	json, err := responseJSONFromFile(file)
+	payload, err := previewPayloadFromFile(file, "")
 	for _, test := range []struct {
 		expected interface{}
 		actual   interface{}
 	}{
 		{fmt.Sprintf("open %v: no such file or directory", file.Name()), err.Error()},
-		{"", string(json)},
+		{"", payload.ContentHash},
 	} {
 		if test.actual != test.expected {
 			t.Errorf("Expected %v but got %v", test.expected, test.actual)
@@ -61,22 +64,75 @@ func TestRunCommand(t *testing.T) {
 	os.Setenv("AWS_REGION", "us-east-1")
 	os.Setenv("AWS_ACCESS_KEY_ID", "foo")
 	os.Setenv("AWS_SECRET_ACCESS_KEY", "bar")
+	defer useTestDeliverer(t)()
 	defer gock.Off()
 	gock.New("https://test-bucket.s3.amazonaws.com").
 		Get("/foo/bar/baz.pptx").
 		Reply(200)
 
-	err := runCommand(requestPayload{
+	req := requestPayload{
 		Bucket:             "test-bucket",
 		Key:                "foo/bar/baz.pptx",
 		CallbackURL:        "http://internal-foo-test-api.bar.baz/path/to/callback",
 		CallbackHTTPMethod: "PUT",
-	})
+	}
+	j := jobs.create(req)
+	err := runCommand(j.ID, req)
 	// if err != nil {
 	expected := "RequestError: send request failed\ncaused by: Get https://test-bucket.s3.amazonaws.com/foo/bar/baz.pptx: gock: cannot match any request" // FIXME
 	if err.Error() != expected {
 		t.Errorf(`Expected "%v" but got "%v"`, expected, err)
 	}
+	j, _ = jobs.get(j.ID)
+	if j.State != jobFailed {
+		t.Errorf("Expected %v but got %v", jobFailed, j.State)
+	}
+}
+
+func TestRunCommandFailureCallback(t *testing.T) {
+	os.Setenv("AWS_REGION", "us-east-1")
+	os.Setenv("AWS_ACCESS_KEY_ID", "foo")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "bar")
+	defer useTestDeliverer(t)()
+	defer gock.Off()
+	gock.New("http://internal-foo-test-api.bar.baz").
+		Put("/path/to/callback").
+		MatchType("json").
+		BodyString(`"status":"failed","error":\{"code":"download_failed"`).
+		Reply(200)
+
+	req := requestPayload{
+		Bucket:             "test-bucket",
+		Key:                "foo/bar/baz.pptx",
+		CallbackURL:        "http://internal-foo-test-api.bar.baz/path/to/callback",
+		CallbackHTTPMethod: "PUT",
+	}
+	j := jobs.create(req)
+	err := runCommand(j.ID, req)
+	cerr, _ := err.(*conversionError)
+	j, _ = jobs.get(j.ID)
+	for _, test := range []struct {
+		expected interface{}
+		actual   interface{}
+	}{
+		{true, cerr != nil},
+		{codeDownloadFailed, j.ErrorCode},
+		{jobFailed, j.State},
+		{true, gock.IsDone()},
+	} {
+		if test.expected != test.actual {
+			t.Errorf("Expected %v but got %v", test.expected, test.actual)
+		}
+	}
+}
+
+func TestFailureJSON(t *testing.T) {
+	json, _ := failureJSON(&conversionError{Code: codeConversionTimeout, Err: &timeoutError{After: time.Minute}})
+	actual := string(json)
+	expected := `{"status":"failed","error":{"code":"conversion_timeout","message":"Conversion timed out after 1m0s"}}`
+	if actual != expected {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
 }
 
 func TestSendCallback(t *testing.T) {
@@ -137,3 +193,36 @@ func TestParsePDFInfoNoMatch(t *testing.T) {
 		}
 	}
 }
+
+func TestRunCommandPanic(t *testing.T) {
+	defer useTestDeliverer(t)()
+	orig := profiles
+	// runWriter panics on a missing profile manager.
+	profiles = nil
+	defer func() { profiles = orig }()
+	root, _ := ioutil.TempDir("", "storage")
+	defer os.RemoveAll(root)
+	os.Setenv("STORAGE_FILE_ROOT", root)
+	defer os.Unsetenv("STORAGE_FILE_ROOT")
+	ioutil.WriteFile(root+"/deck.pptx", []byte("pptx"), 0644)
+
+	defer gock.Off()
+	gock.New("http://internal-foo-test-api.bar.baz").
+		Post("/path/to/callback").
+		MatchType("json").
+		BodyString(`"status":"failed".*"code":"internal_error"`).
+		Reply(200)
+
+	req := requestPayload{
+		Source:      "file:///deck.pptx",
+		CallbackURL: "http://internal-foo-test-api.bar.baz/path/to/callback",
+	}
+	validateRequest(&req)
+	j := jobs.create(req)
+	err := runCommand(j.ID, req)
+	cerr, ok := err.(*conversionError)
+	actual, _ := jobs.get(j.ID)
+	if !ok || cerr.Code != codeInternalError || actual.State != jobFailed || !gock.IsDone() {
+		t.Errorf("Expected a failed job with %v but got %v %v %v", codeInternalError, err, actual.State, gock.IsDone())
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"io"
+	"strings"
+	"time"
+)
+
+// documentProperties describe the source document as its author saw it.
+type documentProperties struct {
+	Title       string     `json:"title,omitempty"`
+	Author      string     `json:"author,omitempty"`
+	Created     *time.Time `json:"created,omitempty"`
+	Modified    *time.Time `json:"modified,omitempty"`
+	Application string     `json:"application,omitempty"`
+}
+
+const (
+	nsDublinCore   = "http://purl.org/dc/elements/1.1/"
+	nsDCTerms      = "http://purl.org/dc/terms/"
+	nsOOXMLApp     = "http://schemas.openxmlformats.org/officeDocument/2006/extended-properties"
+	nsOpenDocument = "urn:oasis:names:tc:opendocument:xmlns:meta:1.0"
+)
+
+// propertyDateLayouts cover W3CDTF as written by Office and the zone-less
+// timestamps LibreOffice writes to meta.xml.
+var propertyDateLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999", "2006-01-02"}
+
+// sourceProperties reads the properties of OOXML and OpenDocument files.
+// Other formats, and packages without properties, give nil.
+func sourceProperties(filename string) *documentProperties {
+	r, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil
+	}
+	defer r.Close()
+	fields := map[string]string{}
+	for _, f := range r.File {
+		switch f.Name {
+		case "docProps/core.xml", "docProps/app.xml", "meta.xml":
+			if rc, err := f.Open(); err == nil {
+				readXMLFields(rc, fields)
+				rc.Close()
+			}
+		}
+	}
+	p := documentProperties{
+		Title:       fields[nsDublinCore+" title"],
+		Author:      firstNonEmpty(fields[nsOpenDocument+" initial-creator"], fields[nsDublinCore+" creator"]),
+		Created:     parsePropertyDate(firstNonEmpty(fields[nsDCTerms+" created"], fields[nsOpenDocument+" creation-date"])),
+		Modified:    parsePropertyDate(firstNonEmpty(fields[nsDCTerms+" modified"], fields[nsDublinCore+" date"])),
+		Application: firstNonEmpty(fields[nsOOXMLApp+" Application"], fields[nsOpenDocument+" generator"]),
+	}
+	if p == (documentProperties{}) {
+		return nil
+	}
+	return &p
+}
+
+// pdfProperties falls back on the PDF's information dictionary, whose
+// Creator is the application the document was made with.
+func pdfProperties(info pdfInfo) *documentProperties {
+	p := documentProperties{
+		Title:       info.Title,
+		Author:      info.Author,
+		Application: info.Creator,
+	}
+	if !info.Created.IsZero() {
+		p.Created = &info.Created
+	}
+	if !info.Modified.IsZero() {
+		p.Modified = &info.Modified
+	}
+	if p == (documentProperties{}) {
+		return nil
+	}
+	return &p
+}
+
+// readXMLFields records the text of every leaf element in r, keyed by its
+// namespace and local name. The first occurrence wins.
+func readXMLFields(r io.Reader, fields map[string]string) {
+	decoder := xml.NewDecoder(r)
+	var name string
+	var text strings.Builder
+	for {
+		tok, err := decoder.Token()
+		if err != nil {
+			return
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name = t.Name.Space + " " + t.Name.Local
+			text.Reset()
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			key := t.Name.Space + " " + t.Name.Local
+			if key == name {
+				if _, ok := fields[key]; !ok {
+					fields[key] = strings.TrimSpace(text.String())
+				}
+			}
+			name = ""
+		}
+	}
+}
+
+func parsePropertyDate(s string) *time.Time {
+	for _, layout := range propertyDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return &t
+		}
+	}
+	return nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func writeTestPackage(t *testing.T, files map[string]string) string {
+	f, err := ioutil.TempFile("", "package")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := zip.NewWriter(f)
+	for name, content := range files {
+		fw, _ := w.Create(name)
+		fw.Write([]byte(content))
+	}
+	w.Close()
+	f.Close()
+	return f.Name()
+}
+
+func TestSourceProperties(t *testing.T) {
+	docx := writeTestPackage(t, map[string]string{
+		"docProps/core.xml": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<cp:coreProperties xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:dcterms="http://purl.org/dc/terms/" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+<dc:title>Quarterly Report</dc:title><dc:creator>sata</dc:creator><cp:lastModifiedBy>ngs</cp:lastModifiedBy>
+<dcterms:created xsi:type="dcterms:W3CDTF">2016-10-21T03:52:28Z</dcterms:created><dcterms:modified xsi:type="dcterms:W3CDTF">2016-10-22T01:00:00Z</dcterms:modified>
+</cp:coreProperties>`,
+		"docProps/app.xml": `<Properties xmlns="http://schemas.openxmlformats.org/officeDocument/2006/extended-properties"><Application>Microsoft Office Word</Application><Pages>3</Pages></Properties>`,
+	})
+	defer os.Remove(docx)
+	odt := writeTestPackage(t, map[string]string{
+		"meta.xml": `<office:document-meta xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:meta="urn:oasis:names:tc:opendocument:xmlns:meta:1.0" xmlns:dc="http://purl.org/dc/elements/1.1/"><office:meta>
+<meta:generator>LibreOffice/6.4.7.2$Linux_X86_64</meta:generator><meta:initial-creator>sata</meta:initial-creator><dc:creator>ngs</dc:creator>
+<meta:creation-date>2016-10-21T12:52:28.123000000</meta:creation-date><dc:date>2016-10-22T10:00:00</dc:date></office:meta></office:document-meta>`,
+	})
+	defer os.Remove(odt)
+	empty := writeTestPackage(t, map[string]string{"content.xml": "<doc/>"})
+	defer os.Remove(empty)
+
+	for _, test := range []struct {
+		expected string
+		filename string
+	}{
+		{`{"title":"Quarterly Report","author":"sata","created":"2016-10-21T03:52:28Z","modified":"2016-10-22T01:00:00Z","application":"Microsoft Office Word"}`, docx},
+		{`{"author":"sata","created":"2016-10-21T12:52:28.123Z","modified":"2016-10-22T10:00:00Z","application":"LibreOffice/6.4.7.2$Linux_X86_64"}`, odt},
+		{`null`, empty},
+		{`null`, "/tmp/does-not-exist.docx"},
+	} {
+		b, _ := json.Marshal(sourceProperties(test.filename))
+		if actual := string(b); actual != test.expected {
+			t.Errorf("Expected %v but got %v", test.expected, actual)
+		}
+	}
+}
+
+func TestPDFProperties(t *testing.T) {
+	created := time.Date(2016, 10, 21, 12, 52, 28, 0, time.UTC)
+	for _, test := range []struct {
+		expected string
+		info     pdfInfo
+	}{
+		{`{"title":"Report","author":"sata","created":"2016-10-21T12:52:28Z","application":"Writer"}`, pdfInfo{Title: "Report", Author: "sata", Creator: "Writer", Producer: "LibreOffice", Created: created}},
+		{`null`, pdfInfo{Producer: "LibreOffice"}},
+	} {
+		b, _ := json.Marshal(pdfProperties(test.info))
+		if actual := string(b); actual != test.expected {
+			t.Errorf("Expected %v but got %v", test.expected, actual)
+		}
+	}
+}
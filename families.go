@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// documentFamily groups source formats LibreOffice opens in the same module
+// and therefore exports with the same filters.
+type documentFamily struct {
+	Name string
+	// Module is the soffice switch loading the document, e.g. "--impress".
+	Module string
+	// Doctype is the family's name for unoconv.
+	Doctype    string
+	Extensions []string
+	// Filters maps output formats the family can produce to the export
+	// filter LibreOffice uses for them.
+	Filters map[string]string
+}
+
+var documentFamilies = map[string]documentFamily{
+	"text": {
+		Name:       "text",
+		Module:     "--writer",
+		Doctype:    "document",
+		Extensions: []string{"doc", "docx", "docm", "dot", "dotx", "odt", "ott", "fodt", "rtf", "txt", "wpd", "htm", "html"},
+		Filters: map[string]string{
+			"pdf":  "writer_pdf_Export",
+			"docx": "MS Word 2007 XML",
+			"odt":  "writer8",
+			"html": "HTML (StarWriter)",
+			"txt":  "Text",
+			"png":  "writer_png_Export",
+		},
+	},
+	"spreadsheet": {
+		Name:       "spreadsheet",
+		Module:     "--calc",
+		Doctype:    "spreadsheet",
+		Extensions: []string{"xls", "xlsx", "xlsm", "xlt", "xltx", "ods", "ots", "fods", "csv"},
+		Filters: map[string]string{
+			"pdf":  "calc_pdf_Export",
+			"xlsx": "Calc MS Excel 2007 XML",
+			"html": "HTML (StarCalc)",
+			"png":  "calc_png_Export",
+		},
+	},
+	"presentation": {
+		Name:       "presentation",
+		Module:     "--impress",
+		Doctype:    "presentation",
+		Extensions: []string{"ppt", "pptx", "pptm", "pps", "ppsx", "pot", "potx", "odp", "otp", "fodp", "key"},
+		Filters: map[string]string{
+			"pdf":  "impress_pdf_Export",
+			"html": "impress_html_Export",
+			"png":  "impress_png_Export",
+		},
+	},
+	"drawing": {
+		Name:       "drawing",
+		Module:     "--draw",
+		Doctype:    "graphics",
+		Extensions: []string{"odg", "otg", "fodg", "vsd", "vsdx", "cdr", "pub"},
+		Filters: map[string]string{
+			"pdf":  "draw_pdf_Export",
+			"html": "draw_html_Export",
+			"png":  "draw_png_Export",
+		},
+	},
+}
+
+// defaultFamily is assumed for keys whose extension is not recognised.
+const defaultFamily = "text"
+
+var filterNameRegexp = regexp.MustCompile("^[A-Za-z0-9_ ().-]+$")
+
+func detectFamily(key string) documentFamily {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(key), "."))
+	for _, f := range documentFamilies {
+		if contains(f.Extensions, ext) {
+			return f
+		}
+	}
+	return documentFamilies[defaultFamily]
+}
+
+// family is the one named in the request or else detected from the key.
+func (req *requestPayload) family() documentFamily {
+	if f, ok := documentFamilies[req.DocumentType]; ok {
+		return f
+	}
+	return detectFamily(req.Key)
+}
+
+// conversion is how one output is produced from the source document.
+type conversion struct {
+	Format outputFormat
+	Family documentFamily
+	Filter string
+	// Options are the filter's JSON options, if any.
+	Options string
+	// OutDir receives the output instead of the source's directory.
+	OutDir string
+}
+
+// target is the --convert-to argument.
+func (c conversion) target() string {
+	if c.Options != "" {
+		return c.Format.Extension + ":" + c.Filter + ":" + c.Options
+	}
+	return c.Format.Extension + ":" + c.Filter
+}
+
+// custom reports whether c departs from the family's default export, which
+// only a one-shot soffice can honour.
+func (c conversion) custom() bool {
+	return c.Filter != c.Family.Filters[c.Format.Name] || c.Options != ""
+}
+
+// outdir is the directory the output of converting filename goes to.
+func (c conversion) outdir(filename string) string {
+	if c.OutDir != "" {
+		return c.OutDir
+	}
+	return filepath.Dir(filename)
+}
+
+// output is the path of the file converting filename produces.
+func (c conversion) output(filename string) string {
+	return filepath.Join(c.outdir(filename), filepath.Base(outputPath(filename, c.Format)))
+}
+
+func (req *requestPayload) conversion(format outputFormat) conversion {
+	family := req.family()
+	filter := req.Filters[format.Name]
+	if filter == "" {
+		filter = family.Filters[format.Name]
+	}
+	c := conversion{Format: format, Family: family, Filter: filter}
+	if format.Name == "pdf" {
+		c.Options = req.pdfOptions().filterOptions()
+	}
+	return c
+}
+
+func validateFamily(req *requestPayload) error {
+	if _, ok := documentFamilies[req.DocumentType]; req.DocumentType != "" && !ok {
+		return fmt.Errorf("Unknown document_type %q, expected text, spreadsheet, presentation or drawing", req.DocumentType)
+	}
+	family := req.family()
+	for _, name := range req.outputs() {
+		if _, ok := family.Filters[name]; !ok && req.Filters[name] == "" {
+			return fmt.Errorf("A %v document cannot be converted to %v", family.Name, name)
+		}
+	}
+	for name, filter := range req.Filters {
+		if !contains(req.outputs(), name) {
+			return fmt.Errorf("Filter given for %v, which was not requested", name)
+		}
+		if !filterNameRegexp.MatchString(filter) {
+			return fmt.Errorf("Invalid filter name %q", filter)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestDetectFamily(t *testing.T) {
+	for _, test := range []struct {
+		expected string
+		key      string
+	}{
+		{"presentation", "/path/to/awesome.pptx"},
+		{"spreadsheet", "/path/to/Report.XLSX"},
+		{"drawing", "/path/to/diagram.odg"},
+		{"text", "/path/to/letter.docx"},
+		{"text", "/path/to/unknown"},
+	} {
+		if actual := detectFamily(test.key).Name; actual != test.expected {
+			t.Errorf("Expected %v but got %v for %v", test.expected, actual, test.key)
+		}
+	}
+}
+
+func TestRequestConversion(t *testing.T) {
+	for _, test := range []struct {
+		expected string
+		module   string
+		req      requestPayload
+	}{
+		{"pdf:impress_pdf_Export", "--impress", requestPayload{Key: "foo.pptx"}},
+		{"pdf:calc_pdf_Export", "--calc", requestPayload{Key: "foo.bin", DocumentType: "spreadsheet"}},
+		{"pdf:writer_web_pdf_Export", "--writer", requestPayload{Key: "foo.docx", Filters: map[string]string{"pdf": "writer_web_pdf_Export"}}},
+	} {
+		c := test.req.conversion(outputFormats["pdf"])
+		if c.target() != test.expected || c.Family.Module != test.module {
+			t.Errorf("Expected %v %v but got %v %v", test.expected, test.module, c.target(), c.Family.Module)
+		}
+	}
+}
+
+func TestValidateFamily(t *testing.T) {
+	for _, test := range []struct {
+		expected string
+		req      requestPayload
+	}{
+		{"", requestPayload{Key: "foo.pptx", Outputs: []string{"pdf", "png"}}},
+		{"", requestPayload{Key: "foo.pptx", Outputs: []string{"pdf", "docx"}, Filters: map[string]string{"docx": "MS Word 2007 XML"}}},
+		{`Unknown document_type "video", expected text, spreadsheet, presentation or drawing`, requestPayload{Key: "foo.pptx", DocumentType: "video"}},
+		{"A presentation document cannot be converted to xlsx", requestPayload{Key: "foo.pptx", Outputs: []string{"xlsx"}}},
+		{"Filter given for png, which was not requested", requestPayload{Key: "foo.pptx", Filters: map[string]string{"png": "impress_png_Export"}}},
+		{`Invalid filter name "pdf:x;y"`, requestPayload{Key: "foo.pptx", Filters: map[string]string{"pdf": "pdf:x;y"}}},
+	} {
+		actual := ""
+		if err := validateFamily(&test.req); err != nil {
+			actual = err.Error()
+		}
+		if actual != test.expected {
+			t.Errorf("Expected %v but got %v", test.expected, actual)
+		}
+	}
+}
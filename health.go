@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type healthCheck struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type readinessResponse struct {
+	Ready  bool                   `json:"ready"`
+	Checks map[string]healthCheck `json:"checks"`
+	Queue  queueStatus            `json:"queue"`
+}
+
+type selfTestResponse struct {
+	OK       bool              `json:"ok"`
+	Error    string            `json:"error,omitempty"`
+	Timings  map[string]int64  `json:"timings_ms"`
+	Versions map[string]string `json:"versions"`
+	Width    int               `json:"width,omitempty"`
+	Height   int               `json:"height,omitempty"`
+}
+
+func newHealthCheck(err error) healthCheck {
+	if err != nil {
+		return healthCheck{Error: err.Error()}
+	}
+	return healthCheck{OK: true}
+}
+
+// handleHealthz tells the orchestrator the process is alive.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports whether the server can take more work: the queue has
+// room, the temp directory is writable and, when READY_STORAGE_URI is set,
+// the storage it names answers.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	res := readinessResponse{Ready: true, Checks: map[string]healthCheck{}, Queue: workers.status()}
+	res.Checks["queue"] = newHealthCheck(checkQueue(res.Queue))
+	res.Checks["temp_dir"] = newHealthCheck(checkTempDir())
+	if uri := os.Getenv("READY_STORAGE_URI"); uri != "" {
+		res.Checks["storage"] = newHealthCheck(checkStorage(uri))
+	}
+	for _, check := range res.Checks {
+		res.Ready = res.Ready && check.OK
+	}
+	status := http.StatusOK
+	if !res.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, res)
+}
+
+func checkQueue(status queueStatus) error {
+	if !workers.accepting() {
+		return errShuttingDown
+	}
+	if status.Depth >= status.Capacity && status.Busy >= status.Workers {
+		return errQueueFull
+	}
+	return nil
+}
+
+func checkTempDir() error {
+	f, err := ioutil.TempFile("", "readyz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write([]byte("ok"))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// checkStorage looks up the object at uri. A missing object still shows the
+// storage is reachable.
+func checkStorage(uri string) error {
+	loc, err := parseStorageURI(uri)
+	if err != nil {
+		return err
+	}
+	store, err := newStorage(loc)
+	if err != nil {
+		return err
+	}
+	if _, err := store.Head(loc.Key); err != nil && err != errObjectNotFound {
+		return err
+	}
+	return nil
+}
+
+// handleSelfTest converts the bundled document to PDF on the workers,
+// measures it and reports how long each step took along with the versions
+// of the tools involved.
+func handleSelfTest(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*time.Duration(envInt("SELFTEST_TIMEOUT_SECONDS", 60)))
+	defer cancel()
+	done := make(chan selfTestResponse, 1)
+	if err := workers.submit(func() { done <- selfTest(ctx) }); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, errorResponse{Error: err.Error(), Queue: workers.status()})
+		return
+	}
+	var res selfTestResponse
+	select {
+	case res = <-done:
+	case <-ctx.Done():
+		res = selfTestResponse{Error: ctx.Err().Error()}
+	}
+	status := http.StatusOK
+	if !res.OK {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, res)
+}
+
+func selfTest(ctx context.Context) selfTestResponse {
+	res := selfTestResponse{Timings: map[string]int64{}, Versions: map[string]string{}}
+	if err := runSelfTest(ctx, &res); err != nil {
+		res.Error = err.Error()
+	} else {
+		res.OK = true
+	}
+	return res
+}
+
+func runSelfTest(ctx context.Context, res *selfTestResponse) error {
+	start := time.Now()
+	res.Versions["libreoffice"] = commandVersion(ctx, envString("SOFFICE_PATH", "soffice"), "--headless", "--version")
+	// PDFs are only read with pdfinfo when it is configured.
+	if bin := os.Getenv("PDF_INFO_PATH"); bin != "" {
+		res.Versions["pdfinfo"] = commandVersion(ctx, bin, "-v")
+	}
+
+	dir, err := ioutil.TempDir("", "selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	source := envString("SELFTEST_DOCUMENT_PATH", filepath.Join("selftest", "selftest.fodt"))
+	b, err := ioutil.ReadFile(source)
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(dir, filepath.Base(source))
+	if err := ioutil.WriteFile(filename, b, 0644); err != nil {
+		return err
+	}
+
+	req := requestPayload{Key: filename}
+	c := req.conversion(outputFormats["pdf"])
+	step := time.Now()
+	err = runWriter(ctx, filename, c)
+	res.Timings["convert"] = msSince(step)
+	if err != nil {
+		return err
+	}
+	step = time.Now()
+	res.Width, res.Height, err = pdfSize(outputPath(filename, c.Format))
+	res.Timings["inspect"] = msSince(step)
+	res.Timings["total"] = msSince(start)
+	return err
+}
+
+// commandVersion returns the first line name prints about its version, or
+// an empty string when it cannot be run.
+func commandVersion(ctx context.Context, name string, args ...string) string {
+	var out bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := runWithTimeout(ctx, cmd); err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(out.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return ""
+}
+
+func msSince(t time.Time) int64 {
+	return int64(time.Since(t) / time.Millisecond)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestHandleHealthz(t *testing.T) {
+	w := httptest.NewRecorder()
+	handleHealthz(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "ok\n" {
+		t.Errorf("Expected 200 ok but got %v %v", w.Code, w.Body.String())
+	}
+}
+
+func TestHandleReadyz(t *testing.T) {
+	defer useTestWorkers(1, 1)()
+	root, _ := ioutil.TempDir("", "storage")
+	defer os.RemoveAll(root)
+	os.Setenv("STORAGE_FILE_ROOT", root)
+	defer os.Unsetenv("STORAGE_FILE_ROOT")
+	defer os.Unsetenv("READY_STORAGE_URI")
+
+	readyz := func() (int, readinessResponse) {
+		w := httptest.NewRecorder()
+		handleReadyz(w, httptest.NewRequest("GET", "/readyz", nil))
+		var res readinessResponse
+		json.NewDecoder(w.Body).Decode(&res)
+		return w.Code, res
+	}
+	os.Setenv("READY_STORAGE_URI", "file:///healthcheck")
+	code, res := readyz()
+	if code != http.StatusOK || !res.Ready || len(res.Checks) != 3 {
+		t.Errorf("Expected ready with 3 checks but got %v %v", code, res)
+	}
+
+	os.Setenv("READY_STORAGE_URI", "https://files.example.com/healthcheck")
+	code, res = readyz()
+	if expected := errHTTPStorageOff.Error(); code != http.StatusServiceUnavailable || res.Checks["storage"].Error != expected {
+		t.Errorf("Expected %v but got %v %v", expected, code, res.Checks["storage"])
+	}
+
+	os.Unsetenv("READY_STORAGE_URI")
+	workers.close()
+	code, res = readyz()
+	if expected := errShuttingDown.Error(); code != http.StatusServiceUnavailable || res.Checks["queue"].Error != expected {
+		t.Errorf("Expected %v but got %v %v", expected, code, res.Checks["queue"])
+	}
+}
+
+func TestHandleSelfTest(t *testing.T) {
+	defer useTestProfiles(t)()
+	os.Setenv("SOFFICE_PATH", "mock-commands/soffice")
+	os.Setenv("PDF_INFO_PATH", "mock-commands/pdfinfo")
+	profiles.prepare()
+
+	w := httptest.NewRecorder()
+	handleSelfTest(w, httptest.NewRequest("GET", "/selftest", nil))
+	var res selfTestResponse
+	json.NewDecoder(w.Body).Decode(&res)
+	_, timed := res.Timings["total"]
+	for _, test := range []struct {
+		expected interface{}
+		actual   interface{}
+	}{
+		{http.StatusOK, w.Code},
+		{true, res.OK},
+		{"", res.Error},
+		{"LibreOffice 7.6.4.1 60(Build:1)", res.Versions["libreoffice"]},
+		{"pdfinfo version 23.02.0", res.Versions["pdfinfo"]},
+		{842, res.Width},
+		{595, res.Height},
+		{true, timed},
+	} {
+		if test.expected != test.actual {
+			t.Errorf("Expected %v but got %v", test.expected, test.actual)
+		}
+	}
+
+	os.Unsetenv("PDF_INFO_PATH")
+	w = httptest.NewRecorder()
+	handleSelfTest(w, httptest.NewRequest("GET", "/selftest", nil))
+	res = selfTestResponse{}
+	json.NewDecoder(w.Body).Decode(&res)
+	if _, probed := res.Versions["pdfinfo"]; probed {
+		t.Errorf("Expected no pdfinfo version but got %v", res.Versions)
+	}
+}
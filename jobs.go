@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+type jobState string
+
+const (
+	jobQueued      jobState = "queued"
+	jobDownloading jobState = "downloading"
+	jobConverting  jobState = "converting"
+	jobUploading   jobState = "uploading"
+	jobCallingBack jobState = "calling_back"
+	jobCompleted   jobState = "completed"
+	jobFailed      jobState = "failed"
+)
+
+// finished reports whether no further transitions are expected.
+func (s jobState) finished() bool {
+	return s == jobCompleted || s == jobFailed
+}
+
+type jobTransition struct {
+	State jobState  `json:"state"`
+	At    time.Time `json:"at"`
+}
+
+type job struct {
+	ID        string          `json:"id"`
+	State     jobState        `json:"state"`
+	Request   requestPayload  `json:"request"`
+	Error     string          `json:"error,omitempty"`
+	ErrorCode string          `json:"error_code,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	History   []jobTransition `json:"history"`
+	// durable jobs are recorded in the registry's store.
+	durable bool
+}
+
+// jobRegistry keeps every accepted job in memory. Finished jobs beyond limit
+// are forgotten oldest first so the registry does not grow without bound.
+type jobRegistry struct {
+	mu    sync.RWMutex
+	jobs  map[string]*job
+	order []string
+	limit int
+	store *jobStore
+}
+
+var jobs = newJobRegistry(envInt("JOB_HISTORY_LIMIT", 1000))
+
+func newJobRegistry(limit int) *jobRegistry {
+	return &jobRegistry{
+		jobs:  map[string]*job{},
+		limit: limit,
+	}
+}
+
+func newJobID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (r *jobRegistry) create(req requestPayload) job {
+	j, _ := r.add(req, false)
+	return j
+}
+
+// add registers a job for req. Durable jobs are recorded in the store, when
+// there is one, before add returns.
+func (r *jobRegistry) add(req requestPayload, durable bool) (job, error) {
+	now := time.Now().UTC()
+	j := &job{
+		ID:        newJobID(),
+		State:     jobQueued,
+		Request:   req,
+		CreatedAt: now,
+		UpdatedAt: now,
+		History:   []jobTransition{{State: jobQueued, At: now}},
+		durable:   durable,
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if durable && r.store != nil {
+		if err := r.store.append(jobRecord{job: *j}); err != nil {
+			return job{}, err
+		}
+	}
+	r.jobs[j.ID] = j
+	r.order = append(r.order, j.ID)
+	r.prune()
+	return j.snapshot(), nil
+}
+
+// transition records a new state for the job. Unknown IDs are ignored so
+// conversions started outside the registry still run.
+func (r *jobRegistry) transition(id string, state jobState, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	j, ok := r.jobs[id]
+	if !ok {
+		return
+	}
+	now := time.Now().UTC()
+	j.State = state
+	j.UpdatedAt = now
+	j.History = append(j.History, jobTransition{State: state, At: now})
+	if err != nil {
+		j.Error = err.Error()
+	}
+	if cerr, ok := err.(*conversionError); ok {
+		j.ErrorCode = cerr.Code
+	}
+	r.record(jobRecord{job: *j})
+}
+
+func (r *jobRegistry) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	j, ok := r.jobs[id]
+	if !ok {
+		return
+	}
+	r.record(jobRecord{job: job{ID: id, durable: j.durable}, Removed: true})
+	delete(r.jobs, id)
+	for i, v := range r.order {
+		if v == id {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func (r *jobRegistry) get(id string) (job, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	j, ok := r.jobs[id]
+	if !ok {
+		return job{}, false
+	}
+	return j.snapshot(), true
+}
+
+// list returns jobs newest first, optionally filtered by state.
+func (r *jobRegistry) list(state jobState) []job {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	result := []job{}
+	for i := len(r.order) - 1; i >= 0; i-- {
+		j := r.jobs[r.order[i]]
+		if state != "" && j.State != state {
+			continue
+		}
+		result = append(result, j.snapshot())
+	}
+	return result
+}
+
+func (r *jobRegistry) prune() {
+	if r.limit <= 0 || len(r.order) <= r.limit {
+		return
+	}
+	excess := len(r.order) - r.limit
+	kept := r.order[:0]
+	for _, id := range r.order {
+		if excess > 0 && r.jobs[id].State.finished() {
+			delete(r.jobs, id)
+			excess--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	r.order = kept
+}
+
+func (j *job) snapshot() job {
+	c := *j
+	c.History = append([]jobTransition(nil), j.History...)
+	return c
+}
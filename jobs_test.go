@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestJobRegistryTransition(t *testing.T) {
+	r := newJobRegistry(10)
+	j := r.create(requestPayload{Bucket: "test-bucket", Key: "foo.pptx"})
+	r.transition(j.ID, jobDownloading, nil)
+	r.transition(j.ID, jobFailed, errors.New("Oh"))
+	actual, ok := r.get(j.ID)
+	for _, test := range []struct {
+		expected interface{}
+		actual   interface{}
+	}{
+		{true, ok},
+		{jobFailed, actual.State},
+		{"Oh", actual.Error},
+		{3, len(actual.History)},
+		{jobDownloading, actual.History[1].State},
+	} {
+		if test.expected != test.actual {
+			t.Errorf("Expected %v but got %v", test.expected, test.actual)
+		}
+	}
+}
+
+func TestJobRegistryPrune(t *testing.T) {
+	r := newJobRegistry(2)
+	first := r.create(requestPayload{Key: "1"})
+	second := r.create(requestPayload{Key: "2"})
+	r.transition(second.ID, jobCompleted, nil)
+	r.create(requestPayload{Key: "3"})
+	if _, ok := r.get(second.ID); ok {
+		t.Errorf("Expected finished job %v to be pruned", second.ID)
+	}
+	if _, ok := r.get(first.ID); !ok {
+		t.Errorf("Expected queued job %v to be kept", first.ID)
+	}
+	if l := len(r.list(jobQueued)); l != 2 {
+		t.Errorf("Expected 2 but got %v", l)
+	}
+}
+
+func TestHandleJob(t *testing.T) {
+	j := jobs.create(requestPayload{Bucket: "test-bucket", Key: "foo.pptx"})
+	w := httptest.NewRecorder()
+	handleJob(w, httptest.NewRequest("GET", "/jobs/"+j.ID, nil))
+	var actual job
+	json.NewDecoder(w.Body).Decode(&actual)
+	for _, test := range []struct {
+		expected interface{}
+		actual   interface{}
+	}{
+		{http.StatusOK, w.Code},
+		{j.ID, actual.ID},
+		{jobQueued, actual.State},
+		{"foo.pptx", actual.Request.Key},
+	} {
+		if test.expected != test.actual {
+			t.Errorf("Expected %v but got %v", test.expected, test.actual)
+		}
+	}
+}
+
+func TestHandleJobNotFound(t *testing.T) {
+	w := httptest.NewRecorder()
+	handleJob(w, httptest.NewRequest("GET", "/jobs/nope", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected %v but got %v", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestHandleConvertRequestBadMethod(t *testing.T) {
+	w := httptest.NewRecorder()
+	handleConvertRequest(w, httptest.NewRequest("GET", "/", strings.NewReader("")))
+	expected := "We don't accept GET requests\n"
+	if w.Code != http.StatusBadRequest || w.Body.String() != expected {
+		t.Errorf(`Expected "%v" but got "%v"`, expected, w.Body.String())
+	}
+}
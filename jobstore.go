@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+)
+
+// jobRecord is one line of the job log: a job as it stands after a change,
+// or the ID of a job that was dropped.
+type jobRecord struct {
+	job
+	Removed bool `json:"removed,omitempty"`
+}
+
+// jobStore persists accepted jobs as JSON lines so they survive restarts.
+// The log is append only between compactions, which rewrite it with the
+// latest record of every job still known. Callers serialise access.
+type jobStore struct {
+	path string
+	file *os.File
+	// appended counts records written since the last compaction.
+	appended  int
+	compactAt int
+}
+
+// loadJobs replays the log at path, returning jobs in the order they were
+// first recorded. A torn last line, left by a crash mid-write, is skipped.
+func loadJobs(path string) ([]*job, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	latest := map[string]*job{}
+	var order []string
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var r jobRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil || r.ID == "" {
+			continue
+		}
+		if _, ok := latest[r.ID]; !ok {
+			order = append(order, r.ID)
+		}
+		if r.Removed {
+			latest[r.ID] = nil
+			continue
+		}
+		j := r.job
+		latest[r.ID] = &j
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	var result []*job
+	for _, id := range order {
+		if j := latest[id]; j != nil {
+			result = append(result, j)
+		}
+	}
+	return result, nil
+}
+
+func (s *jobStore) append(r jobRecord) error {
+	b, err := json.Marshal(&r)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	s.appended++
+	return s.file.Sync()
+}
+
+// compact replaces the log with one record per job.
+func (s *jobStore) compact(jobs []*job) error {
+	var buf bytes.Buffer
+	for _, j := range jobs {
+		b, err := json.Marshal(&jobRecord{job: *j})
+		if err != nil {
+			return err
+		}
+		buf.Write(append(b, '\n'))
+	}
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if s.file != nil {
+		s.file.Close()
+	}
+	s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_WRONLY, 0600)
+	s.appended = 0
+	return err
+}
+
+// open loads the jobs recorded at path into the registry and records every
+// later change there. It returns the jobs that had not finished.
+func (r *jobRegistry) open(path string) ([]job, error) {
+	loaded, err := loadJobs(path)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var unfinished []job
+	for _, j := range loaded {
+		if _, ok := r.jobs[j.ID]; ok {
+			continue
+		}
+		j.durable = true
+		r.jobs[j.ID] = j
+		r.order = append(r.order, j.ID)
+		if !j.State.finished() {
+			unfinished = append(unfinished, j.snapshot())
+		}
+	}
+	r.prune()
+	r.store = &jobStore{path: path, compactAt: envInt("JOB_STORE_COMPACT_RECORDS", 10000)}
+	if err := r.store.compact(r.durableJobs()); err != nil {
+		r.store = nil
+		return nil, err
+	}
+	return unfinished, nil
+}
+
+// accept creates a job and records it before returning, so that it is
+// resumed should the server stop before the job finishes.
+func (r *jobRegistry) accept(req requestPayload) (job, error) {
+	return r.add(req, true)
+}
+
+// record persists a change to a durable job. Failures are logged rather than
+// failing the conversion, which is already under way.
+func (r *jobRegistry) record(rec jobRecord) {
+	if r.store == nil || !rec.durable {
+		return
+	}
+	if err := r.store.append(rec); err != nil {
+		log.Printf("Failed to record job %v: %v", rec.ID, err)
+		return
+	}
+	if r.store.compactAt > 0 && r.store.appended >= r.store.compactAt {
+		if err := r.store.compact(r.durableJobs()); err != nil {
+			log.Printf("Failed to compact job store: %v", err)
+		}
+	}
+}
+
+// persisted reports whether job id is recorded in the store, and so would
+// be resumed by the next server to open it.
+func (r *jobRegistry) persisted(id string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	j, ok := r.jobs[id]
+	return ok && j.durable && r.store != nil
+}
+
+func (r *jobRegistry) durableJobs() []*job {
+	var result []*job
+	for _, id := range r.order {
+		if j := r.jobs[id]; j.durable {
+			result = append(result, j)
+		}
+	}
+	return result
+}
+
+// resumeJobs queues jobs again, waiting for room in the queue rather than
+// dropping them.
+func resumeJobs(unfinished []job) {
+	for _, j := range unfinished {
+		id, req := j.ID, j.Request
+		jobs.transition(id, jobQueued, nil)
+		for workers.submit(func() { runCommand(id, req) }) == errQueueFull {
+			time.Sleep(time.Second)
+		}
+	}
+	if len(unfinished) > 0 {
+		log.Printf("Resumed %v unfinished jobs", len(unfinished))
+	}
+}
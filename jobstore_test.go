@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJobRegistryOpen(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "jobstore")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jobs.jsonl")
+
+	r := newJobRegistry(10)
+	if _, err := r.open(path); err != nil {
+		t.Fatalf("Expected nil but got %v", err)
+	}
+	running, _ := r.accept(requestPayload{Bucket: "test-bucket", Key: "running.pptx"})
+	done, _ := r.accept(requestPayload{Bucket: "test-bucket", Key: "done.pptx"})
+	dropped, _ := r.accept(requestPayload{Bucket: "test-bucket", Key: "dropped.pptx"})
+	transient := r.create(requestPayload{Bucket: "test-bucket", Key: "transient.pptx"})
+	r.transition(running.ID, jobConverting, nil)
+	r.transition(done.ID, jobCompleted, nil)
+	r.remove(dropped.ID)
+	// A crash mid-write leaves a torn last line.
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	f.WriteString(`{"id":"` + running.ID + `","state":"upl`)
+	f.Close()
+
+	restarted := newJobRegistry(10)
+	unfinished, err := restarted.open(path)
+	if err != nil {
+		t.Fatalf("Expected nil but got %v", err)
+	}
+	if len(unfinished) != 1 {
+		t.Fatalf("Expected 1 unfinished job but got %v", unfinished)
+	}
+	completed, ok := restarted.get(done.ID)
+	_, droppedOK := restarted.get(dropped.ID)
+	_, transientOK := restarted.get(transient.ID)
+	for _, test := range []struct {
+		expected interface{}
+		actual   interface{}
+	}{
+		{running.ID, unfinished[0].ID},
+		{jobConverting, unfinished[0].State},
+		{"running.pptx", unfinished[0].Request.Key},
+		{2, len(unfinished[0].History)},
+		{true, ok},
+		{jobCompleted, completed.State},
+		{false, droppedOK},
+		{false, transientOK},
+	} {
+		if test.expected != test.actual {
+			t.Errorf("Expected %v but got %v", test.expected, test.actual)
+		}
+	}
+}
+
+func TestJobStoreCompact(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "jobstore")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jobs.jsonl")
+
+	r := newJobRegistry(10)
+	r.open(path)
+	r.store.compactAt = 4
+	j, _ := r.accept(requestPayload{Bucket: "test-bucket", Key: "foo.pptx"})
+	for _, state := range []jobState{jobDownloading, jobConverting, jobUploading} {
+		r.transition(j.ID, state, nil)
+	}
+	b, _ := ioutil.ReadFile(path)
+	if lines := bytes.Count(b, []byte("\n")); lines != 1 {
+		t.Errorf("Expected 1 but got %v", lines)
+	}
+	r.transition(j.ID, jobCallingBack, nil)
+	b, _ = ioutil.ReadFile(path)
+	if lines := bytes.Count(b, []byte("\n")); lines != 2 {
+		t.Errorf("Expected 2 but got %v", lines)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var keyTemplateVarRegexp = regexp.MustCompile("\\{([^{}]*)\\}")
+
+// keyTemplateVars are the variables a key template may use.
+var keyTemplateVars = []string{"dir", "basename", "name", "format", "ext", "page", "hash", "job_id"}
+
+// wholeDocumentPage stands in for {page} on outputs covering every page.
+const wholeDocumentPage = "all"
+
+func validateDestination(req *requestPayload) error {
+	if req.DestinationBucket != "" && req.Source != "" && !strings.HasPrefix(req.Source, "s3://") {
+		return errors.New("destination_bucket can only be used with S3 sources")
+	}
+	if req.KeyTemplate == "" {
+		return nil
+	}
+	for _, m := range keyTemplateVarRegexp.FindAllStringSubmatch(req.KeyTemplate, -1) {
+		if !contains(keyTemplateVars, m[1]) {
+			return fmt.Errorf("Unknown key_template variable {%v}, expected one of {%v}", m[1], strings.Join(keyTemplateVars, "}, {"))
+		}
+	}
+	if strings.ContainsAny(keyTemplateVarRegexp.ReplaceAllString(req.KeyTemplate, ""), "{}") {
+		return errors.New("Unbalanced braces in key_template")
+	}
+	for _, segment := range strings.Split(req.KeyTemplate, "/") {
+		if segment == ".." {
+			return errors.New("key_template may not contain .. segments")
+		}
+	}
+	// Hashes are not known yet, so outputs must be told apart by the
+	// other variables.
+	seen := map[string]string{}
+	for _, output := range req.plannedOutputs() {
+		key := renderKeyTemplate(req.KeyTemplate, keyTemplateValues(req.Key, "", output, ""))
+		if other, ok := seen[key]; ok {
+			return fmt.Errorf("key_template gives %v and %v the same key %v", other, output.Name, key)
+		}
+		seen[key] = output.Name
+	}
+	return nil
+}
+
+// plannedOutputs lists what a request will upload, pages of thumbnails
+// included, before anything has been converted.
+func (req *requestPayload) plannedOutputs() []pendingOutput {
+	var outputs []pendingOutput
+	for _, name := range req.outputs() {
+		format := outputFormats[name]
+		outputs = append(outputs, pendingOutput{Name: outputName(format), Key: convertOutputKey(req.Key, format), Format: format})
+	}
+	for _, spec := range req.Thumbnails {
+		for page := 1; page <= spec.pages(); page++ {
+			outputs = append(outputs, pendingOutput{Name: thumbnailName(spec, page), Key: convertThumbnailKey(req.Key, spec, page), Format: spec.format(), Page: page})
+		}
+	}
+	if format, ok := textFormats[req.ExtractText]; ok {
+		outputs = append(outputs, pendingOutput{Name: "text", Key: convertTextKey(req.Key, format), Format: format})
+	}
+	return outputs
+}
+
+var unknownKeyTemplateVarRegexp = regexp.MustCompile("\\{(hash|job_id)\\}")
+
+// plannedKeys lists the keys a request will write to. Hashes and job ids
+// are not known yet, so a key template is only rendered up to the first of
+// them: whatever they turn out to be, the key starts with what is listed.
+func (req *requestPayload) plannedKeys() []string {
+	template := req.KeyTemplate
+	if loc := unknownKeyTemplateVarRegexp.FindStringIndex(template); loc != nil {
+		template = template[:loc[0]]
+	}
+	var keys []string
+	for _, output := range req.plannedOutputs() {
+		if req.KeyTemplate == "" {
+			keys = append(keys, output.Key)
+			continue
+		}
+		key := renderKeyTemplate(template, keyTemplateValues(req.Key, "", output, ""))
+		if key != "" && strings.HasSuffix(template, "/") {
+			key += "/"
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func keyTemplateValues(sourceKey, jobID string, output pendingOutput, hash string) map[string]string {
+	base := path.Base(sourceKey)
+	dir := path.Dir(strings.TrimPrefix(sourceKey, "/"))
+	if dir == "." {
+		dir = ""
+	}
+	page := wholeDocumentPage
+	if output.Page > 0 {
+		page = strconv.Itoa(output.Page)
+	}
+	return map[string]string{
+		"dir":      dir,
+		"basename": strings.TrimSuffix(base, path.Ext(base)),
+		"name":     output.Name,
+		"format":   output.Format.Name,
+		"ext":      output.Format.Extension,
+		"page":     page,
+		"hash":     hash,
+		"job_id":   jobID,
+	}
+}
+
+// renderKeyTemplate fills in the template, collapsing the empty segments an
+// empty {dir} leaves behind.
+func renderKeyTemplate(template string, values map[string]string) string {
+	key := keyTemplateVarRegexp.ReplaceAllStringFunc(template, func(v string) string {
+		return values[strings.Trim(v, "{}")]
+	})
+	cleaned := path.Clean("/" + key)
+	if strings.HasPrefix(template, "/") {
+		return cleaned
+	}
+	return strings.TrimPrefix(cleaned, "/")
+}
+
+// outputKey is where output is stored: by the request's key template when
+// it has one, and next to the source otherwise.
+func (req *requestPayload) outputKey(jobID string, output pendingOutput, hash string) string {
+	if req.KeyTemplate == "" {
+		return output.Key
+	}
+	return renderKeyTemplate(req.KeyTemplate, keyTemplateValues(req.Key, jobID, output, hash))
+}
+
+// destination opens the storage outputs are written to.
+func (req *requestPayload) destination(source Storage) (Storage, error) {
+	if req.DestinationBucket == "" {
+		return source, nil
+	}
+	return newStorage(storageLocation{Scheme: "s3", Bucket: req.DestinationBucket})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	gock "gopkg.in/h2non/gock.v1"
+)
+
+func TestValidateDestination(t *testing.T) {
+	for _, test := range []struct {
+		expected string
+		req      requestPayload
+	}{
+		{"", requestPayload{Key: "/docs/deck.pptx", DestinationBucket: "cdn"}},
+		{"", requestPayload{Key: "/docs/deck.pptx", KeyTemplate: "previews/{dir}/{basename}/{format}/{page}.{ext}", Thumbnails: []thumbnailSpec{{Width: 200, Pages: 3}}}},
+		{"destination_bucket can only be used with S3 sources", requestPayload{Source: "file:///docs/deck.pptx", Key: "/docs/deck.pptx", DestinationBucket: "cdn"}},
+		{"Unknown key_template variable {size}, expected one of {dir}, {basename}, {name}, {format}, {ext}, {page}, {hash}, {job_id}", requestPayload{Key: "deck.pptx", KeyTemplate: "{basename}-{size}.{ext}"}},
+		{"Unbalanced braces in key_template", requestPayload{Key: "deck.pptx", KeyTemplate: "{basename.{ext}"}},
+		{"key_template may not contain .. segments", requestPayload{Key: "deck.pptx", KeyTemplate: "../{name}.{ext}"}},
+		{"key_template gives p1-200w.png and p1-400w.png the same key previews/deck/png/1.png", requestPayload{Key: "deck.pptx", KeyTemplate: "previews/{basename}/{format}/{page}.{ext}", Thumbnails: []thumbnailSpec{{Width: 200}, {Width: 400}}}},
+		{"key_template gives preview and docx the same key previews/deck-.", requestPayload{Key: "deck.pptx", KeyTemplate: "previews/{basename}-{hash}.", Outputs: []string{"pdf", "docx"}}},
+	} {
+		actual := ""
+		if err := validateDestination(&test.req); err != nil {
+			actual = err.Error()
+		}
+		if actual != test.expected {
+			t.Errorf("Expected %v but got %v", test.expected, actual)
+		}
+	}
+}
+
+func TestOutputKey(t *testing.T) {
+	thumbnail := pendingOutput{Key: "/docs/deck-preview-p2-200w.png", Name: "p2-200w.png", Format: imageFormats["png"], Page: 2}
+	preview := pendingOutput{Key: "/docs/deck-preview.pdf", Name: "preview", Format: outputFormats["pdf"]}
+	for _, test := range []struct {
+		expected string
+		template string
+		key      string
+		output   pendingOutput
+	}{
+		{"/docs/deck-preview-p2-200w.png", "", "/docs/deck.pptx", thumbnail},
+		{"previews/docs/deck/png/2.png", "previews/{dir}/{basename}/{format}/{page}.{ext}", "/docs/deck.pptx", thumbnail},
+		{"previews/deck/pdf/all.pdf", "previews/{dir}/{basename}/{format}/{page}.{ext}", "deck.pptx", preview},
+		{"/cache/abc123/j1-preview.pdf", "/cache/{hash}/{job_id}-{name}.{ext}", "/docs/deck.pptx", preview},
+	} {
+		req := requestPayload{Key: test.key, KeyTemplate: test.template}
+		if actual := req.outputKey("j1", test.output, "abc123"); actual != test.expected {
+			t.Errorf("Expected %v but got %v", test.expected, actual)
+		}
+	}
+}
+
+func TestRunCommandKeyTemplate(t *testing.T) {
+	defer useTestProfiles(t)()
+	defer useTestDeliverer(t)()
+	os.Setenv("SOFFICE_PATH", "mock-commands/soffice")
+	os.Setenv("PDF_INFO_PATH", "mock-commands/pdfinfo")
+	profiles.prepare()
+	root, _ := ioutil.TempDir("", "storage")
+	defer os.RemoveAll(root)
+	os.Setenv("STORAGE_FILE_ROOT", root)
+	defer os.Unsetenv("STORAGE_FILE_ROOT")
+	os.MkdirAll(filepath.Join(root, "docs"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "docs", "deck.pptx"), []byte("pptx"), 0644)
+
+	defer gock.Off()
+	gock.New("http://internal-foo-test-api.bar.baz").
+		Put("/path/to/callback").
+		Reply(200)
+
+	req := requestPayload{
+		Source:             "file:///docs/deck.pptx",
+		KeyTemplate:        "previews/{dir}/{basename}/{hash}.{ext}",
+		CallbackURL:        "http://internal-foo-test-api.bar.baz/path/to/callback",
+		CallbackHTTPMethod: "PUT",
+	}
+	if err := validateRequest(&req); err != nil {
+		t.Fatalf("Expected nil but got %v", err)
+	}
+	j := jobs.create(req)
+	if err := runCommand(j.ID, req); err != nil {
+		t.Errorf("Expected nil but got %v", err)
+	}
+	// The md5 of the mock's output.
+	b, err := ioutil.ReadFile(filepath.Join(root, "previews", "docs", "deck", "1d93c8b5a50d2d93df1f81fb43929437.pdf"))
+	if expected := "converted with pdf:impress_pdf_Export\n"; string(b) != expected {
+		t.Errorf("Expected %v but got %v %v", expected, string(b), err)
+	}
+}
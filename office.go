@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	errOfficeNotReady    = errors.New("LibreOffice instance did not start listening")
+	errOfficeUnavailable = errors.New("No LibreOffice instance available")
+)
+
+// officeInstance is a long-running soffice process accepting UNO
+// connections on a local port.
+type officeInstance struct {
+	port        int
+	profile     string
+	cmd         *exec.Cmd
+	exited      <-chan error
+	conversions int
+}
+
+func (i *officeInstance) connection() string {
+	return "socket,host=127.0.0.1,port=" + strconv.Itoa(i.port) + ";urp;StarOffice.ComponentContext"
+}
+
+func (i *officeInstance) dead() bool {
+	if i.exited == nil {
+		return true
+	}
+	select {
+	case <-i.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+func (i *officeInstance) healthy() bool {
+	if i.dead() {
+		return false
+	}
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(i.port), time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func (i *officeInstance) stop() {
+	if !i.dead() {
+		terminateGroup(i.cmd.Process.Pid, i.exited, killGrace())
+	}
+	if i.profile != "" {
+		profiles.release(i.profile)
+	}
+}
+
+// officePool keeps soffice instances warm so conversions skip LibreOffice's
+// startup. Instances are replaced when they crash, fail a health check or
+// reach maxConversions.
+type officePool struct {
+	idle           chan *officeInstance
+	maxConversions int
+	startTimeout   time.Duration
+	acquireTimeout time.Duration
+	mu             sync.Mutex
+	closed         bool
+}
+
+// offices is nil unless OFFICE_POOL_SIZE is set, in which case conversions
+// fall back to one-shot soffice only when no instance can be used.
+var offices *officePool
+
+func newOfficePool(size int, basePort int) (*officePool, error) {
+	p := &officePool{
+		idle:           make(chan *officeInstance, size),
+		maxConversions: envInt("OFFICE_MAX_CONVERSIONS", 100),
+		startTimeout:   time.Second * time.Duration(envInt("OFFICE_START_TIMEOUT_SECONDS", 30)),
+		acquireTimeout: time.Second * time.Duration(envInt("OFFICE_ACQUIRE_TIMEOUT_SECONDS", 10)),
+	}
+	for i := 0; i < size; i++ {
+		inst, err := p.start(basePort + i)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		p.idle <- inst
+	}
+	return p, nil
+}
+
+func (p *officePool) start(port int) (*officeInstance, error) {
+	inst := &officeInstance{port: port}
+	profile, err := profiles.create()
+	if err != nil {
+		return inst, err
+	}
+	inst.profile = profile
+	cmd := exec.Command(envString("SOFFICE_PATH", "soffice"),
+		"--headless",
+		profileArg(profile),
+		"--invisible",
+		"--nologo",
+		"--norestore",
+		"--nodefault",
+		"--nolockcheck",
+		"--accept=socket,host=127.0.0.1,port="+strconv.Itoa(port)+";urp;StarOffice.ComponentContext")
+	inst.cmd = cmd
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		inst.stop()
+		return inst, err
+	}
+	exited := make(chan error)
+	inst.exited = exited
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	deadline := time.Now().Add(p.startTimeout)
+	for !inst.healthy() {
+		if inst.dead() || time.Now().After(deadline) {
+			inst.stop()
+			return inst, errOfficeNotReady
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return inst, nil
+}
+
+// acquire takes an idle instance, restarting it first if it is unhealthy.
+func (p *officePool) acquire() (*officeInstance, error) {
+	var inst *officeInstance
+	select {
+	case inst = <-p.idle:
+	case <-time.After(p.acquireTimeout):
+		return nil, errOfficeUnavailable
+	}
+	if inst.healthy() {
+		return inst, nil
+	}
+	inst.stop()
+	fresh, err := p.start(inst.port)
+	if err != nil {
+		p.idle <- fresh
+		return nil, err
+	}
+	return fresh, nil
+}
+
+// release returns inst to the pool, recycling it in the background when it
+// is worn out or no longer trusted.
+func (p *officePool) release(inst *officeInstance, ok bool) {
+	inst.conversions++
+	p.mu.Lock()
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		inst.stop()
+		return
+	}
+	if ok && inst.conversions < p.maxConversions {
+		p.idle <- inst
+		return
+	}
+	go func() {
+		inst.stop()
+		fresh, _ := p.start(inst.port)
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.closed {
+			// close has already drained idle and would never stop fresh.
+			fresh.stop()
+			return
+		}
+		p.idle <- fresh
+	}()
+}
+
+// convert exports filename as c describes, into c's output directory,
+// through an idle instance. It returns errOfficeUnavailable when the caller
+// should fall back to a one-shot conversion.
+func (p *officePool) convert(ctx context.Context, filename string, c conversion) error {
+	if c.custom() {
+		// unoconv picks the filter itself from the doctype.
+		return errOfficeUnavailable
+	}
+	inst, err := p.acquire()
+	if err != nil {
+		return errOfficeUnavailable
+	}
+	cmd := exec.Command(envString("UNOCONV_PATH", "unoconv"),
+		"--connection", inst.connection(),
+		"--doctype", c.Family.Doctype,
+		"--format", c.Format.Extension,
+		"--output", c.outdir(filename)+"/",
+		filename)
+	err = runWithTimeout(ctx, cmd)
+	if err == nil {
+		p.release(inst, true)
+		return nil
+	}
+	if cmd.Process == nil {
+		// unoconv could not be started, which says nothing about inst.
+		p.release(inst, true)
+		return errOfficeUnavailable
+	}
+	if isTimeout(err) || err == ctx.Err() {
+		p.release(inst, false)
+		return err
+	}
+	if inst.healthy() {
+		p.release(inst, true)
+		return err
+	}
+	p.release(inst, false)
+	return errOfficeUnavailable
+}
+
+func (p *officePool) close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	for {
+		select {
+		case inst := <-p.idle:
+			inst.stop()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// listenOfficePort stands in for the UNO socket the mock soffice would open.
+func listenOfficePort(t *testing.T) (net.Listener, int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen %v", err)
+	}
+	return l, l.Addr().(*net.TCPAddr).Port
+}
+
+func TestOfficePoolConvert(t *testing.T) {
+	defer useTestProfiles(t)()
+	os.Setenv("SOFFICE_PATH", "mock-commands/soffice")
+	os.Setenv("UNOCONV_PATH", "mock-commands/unoconv")
+	os.Setenv("OFFICE_MAX_CONVERSIONS", "2")
+	defer os.Unsetenv("OFFICE_MAX_CONVERSIONS")
+	l, port := listenOfficePort(t)
+	defer l.Close()
+	p, err := newOfficePool(1, port)
+	if err != nil {
+		t.Fatalf("Expected nil but got %v", err)
+	}
+	defer p.close()
+	dir, _ := ioutil.TempDir("", "office")
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "foo.pptx")
+
+	first := <-p.idle
+	p.idle <- first
+	for i, expected := range []int{1, 0} {
+		if err := p.convert(context.Background(), filename, conversion{Format: outputFormats["pdf"], Family: documentFamilies["presentation"], Filter: "impress_pdf_Export"}); err != nil {
+			t.Errorf("Expected nil but got %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "foo.pdf")); err != nil {
+			t.Errorf("Expected converted file but got %v", err)
+		}
+		inst := <-p.idle
+		if inst.conversions != expected {
+			t.Errorf("Expected %v conversions after %v but got %v", expected, i+1, inst.conversions)
+		}
+		p.idle <- inst
+	}
+	if !first.dead() {
+		t.Errorf("Expected worn out instance to be stopped")
+	}
+}
+
+func TestOfficePoolMissingUnoconv(t *testing.T) {
+	defer useTestProfiles(t)()
+	os.Setenv("SOFFICE_PATH", "mock-commands/soffice")
+	os.Setenv("UNOCONV_PATH", "mock-commands/missing-unoconv")
+	defer os.Setenv("UNOCONV_PATH", "mock-commands/unoconv")
+	l, port := listenOfficePort(t)
+	defer l.Close()
+	p, err := newOfficePool(1, port)
+	if err != nil {
+		t.Fatalf("Expected nil but got %v", err)
+	}
+	defer p.close()
+	if err := p.convert(context.Background(), "/tmp/foo.pptx", conversion{Format: outputFormats["pdf"], Family: documentFamilies["presentation"], Filter: "impress_pdf_Export"}); err != errOfficeUnavailable {
+		t.Errorf("Expected %v but got %v", errOfficeUnavailable, err)
+	}
+	if inst := <-p.idle; inst.dead() {
+		t.Errorf("Expected instance to stay in the pool")
+	}
+}
+
+func TestOfficePoolUnavailable(t *testing.T) {
+	defer useTestProfiles(t)()
+	os.Setenv("SOFFICE_PATH", "mock-commands/soffice")
+	os.Setenv("OFFICE_START_TIMEOUT_SECONDS", "1")
+	defer os.Unsetenv("OFFICE_START_TIMEOUT_SECONDS")
+	l, port := listenOfficePort(t)
+	p, err := newOfficePool(1, port)
+	if err != nil {
+		t.Fatalf("Expected nil but got %v", err)
+	}
+	defer p.close()
+	l.Close()
+	start := time.Now()
+	if err := p.convert(context.Background(), "/tmp/foo.pptx", conversion{Format: outputFormats["pdf"], Family: documentFamilies["presentation"], Filter: "impress_pdf_Export"}); err != errOfficeUnavailable {
+		t.Errorf("Expected %v but got %v", errOfficeUnavailable, err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Expected restart to give up after start timeout but took %v", d)
+	}
+}
+
+func TestOfficePoolCloseWhileRecycling(t *testing.T) {
+	defer useTestProfiles(t)()
+	os.Setenv("SOFFICE_PATH", "mock-commands/soffice")
+	l, port := listenOfficePort(t)
+	defer l.Close()
+	p, err := newOfficePool(1, port)
+	if err != nil {
+		t.Fatalf("Expected nil but got %v", err)
+	}
+	inst, err := p.acquire()
+	if err != nil {
+		t.Fatalf("Expected nil but got %v", err)
+	}
+	p.release(inst, false)
+	p.close()
+	// Give the recycling goroutine time to start a fresh instance.
+	time.Sleep(time.Second)
+	if len(p.idle) != 0 {
+		inst := <-p.idle
+		inst.stop()
+		t.Errorf("Expected no instance after close but got one")
+	}
+	profiles.mu.RLock()
+	active := len(profiles.active)
+	profiles.mu.RUnlock()
+	if active != 0 {
+		t.Errorf("Expected 0 active profiles but got %v", active)
+	}
+}
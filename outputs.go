@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	_ "image/jpeg" // registers JPEG for image.DecodeConfig
+	_ "image/png"  // registers PNG for image.DecodeConfig
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// outputFormat is a rendition of the source document. The export filter
+// producing it depends on the document's family.
+type outputFormat struct {
+	Name        string
+	Extension   string
+	ContentType string
+}
+
+var outputFormats = map[string]outputFormat{
+	"pdf":  {"pdf", "pdf", "application/pdf"},
+	"docx": {"docx", "docx", "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+	"odt":  {"odt", "odt", "application/vnd.oasis.opendocument.text"},
+	"xlsx": {"xlsx", "xlsx", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+	"html": {"html", "html", "text/html"},
+	"txt":  {"txt", "txt", "text/plain"},
+	"png":  {"png", "png", "image/png"},
+}
+
+// defaultOutputs is used when a request names no outputs.
+var defaultOutputs = []string{"pdf"}
+
+func (req *requestPayload) outputs() []string {
+	if len(req.Outputs) == 0 {
+		return defaultOutputs
+	}
+	return req.Outputs
+}
+
+func validateOutputs(names []string) error {
+	seen := map[string]bool{}
+	for _, name := range names {
+		if _, ok := outputFormats[name]; !ok {
+			return fmt.Errorf("Unknown output %q, expected one of %v", name, outputFormatNames())
+		}
+		if seen[name] {
+			return fmt.Errorf("Output %q requested twice", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+func outputFormatNames() string {
+	names := make([]string, 0, len(outputFormats))
+	for name := range outputFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// outputName is the entry an output is reported under in the callback. The
+// PDF keeps the "preview" name it always had.
+func outputName(format outputFormat) string {
+	if format.Name == "pdf" {
+		return "preview"
+	}
+	return format.Name
+}
+
+// convertOutputKey derives where an output is stored from the source key.
+func convertOutputKey(orgKey string, format outputFormat) string {
+	if format.Name == "pdf" {
+		return convertPreiviewKey(orgKey)
+	}
+	return strings.TrimSuffix(orgKey, filepath.Ext(orgKey)) + "-preview." + format.Extension
+}
+
+// outputPath is where LibreOffice writes filename converted to format.
+func outputPath(filename string, format outputFormat) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + "." + format.Extension
+}
+
+func imageSize(filename string) (int, int, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	c, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	return c.Width, c.Height, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateOutputs(t *testing.T) {
+	for _, test := range []struct {
+		expected string
+		outputs  []string
+	}{
+		{"", nil},
+		{"", []string{"pdf", "docx", "png"}},
+		{`Unknown output "pptx", expected one of docx, html, odt, pdf, png, txt, xlsx`, []string{"pdf", "pptx"}},
+		{`Output "pdf" requested twice`, []string{"pdf", "pdf"}},
+	} {
+		actual := ""
+		if err := validateOutputs(test.outputs); err != nil {
+			actual = err.Error()
+		}
+		if actual != test.expected {
+			t.Errorf("Expected %v but got %v", test.expected, actual)
+		}
+	}
+}
+
+func TestConvertOutputKey(t *testing.T) {
+	for _, test := range []struct {
+		expected string
+		key      string
+		format   string
+	}{
+		{"/foo/bar/baz-preview.pdf", "/foo/bar/baz.qux", "pdf"},
+		{"/foo/bar/baz-preview.docx", "/foo/bar/baz.qux", "docx"},
+		{"/foo/bar/baz-preview.png", "/foo/bar/baz", "png"},
+		{"/foo/bar/baz-preview", "/foo/bar/baz", "pdf"},
+	} {
+		if actual := convertOutputKey(test.key, outputFormats[test.format]); actual != test.expected {
+			t.Errorf("Expected %v but got %v", test.expected, actual)
+		}
+	}
+}
+
+func TestFilePayloadFromFilePNG(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "outputs")
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "foo.png")
+	f, _ := os.Create(filename)
+	png.Encode(f, image.NewGray(image.Rect(0, 0, 200, 150)))
+	f.Close()
+
+	file, _ := os.Open(filename)
+	defer file.Close()
+	payload, err := filePayloadFromFile(file, outputFormats["png"])
+	for _, test := range []struct {
+		expected interface{}
+		actual   interface{}
+	}{
+		{nil, err},
+		{"image/png", payload.ContentType},
+		{200, payload.Width},
+		{150, payload.Height},
+		{32, len(payload.ContentHash)},
+	} {
+		if test.expected != test.actual {
+			t.Errorf("Expected %v but got %v", test.expected, test.actual)
+		}
+	}
+}
+
+func TestHandleConvertRequestUnknownOutput(t *testing.T) {
+	w := httptest.NewRecorder()
+	handleConvertRequest(w, httptest.NewRequest("POST", "/", strings.NewReader(`{"bucket":"test-bucket","key":"foo.pptx","outputs":["pdf","mp4"]}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected %v but got %v", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestRunWriterFormat(t *testing.T) {
+	defer useTestProfiles(t)()
+	os.Setenv("SOFFICE_PATH", "mock-commands/soffice")
+	profiles.prepare()
+	dir, _ := ioutil.TempDir("", "writer")
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "foo.rtf")
+	req := requestPayload{Key: "foo.rtf"}
+
+	for _, test := range []struct {
+		format   string
+		expected string
+	}{
+		{"docx", "converted with docx:MS Word 2007 XML\n"},
+		{"txt", "converted with txt:Text\n"},
+	} {
+		format := outputFormats[test.format]
+		if err := runWriter(context.Background(), filename, req.conversion(format)); err != nil {
+			t.Errorf("Expected nil but got %v", err)
+		}
+		b, _ := ioutil.ReadFile(outputPath(filename, format))
+		if string(b) != test.expected {
+			t.Errorf("Expected %v but got %v", test.expected, string(b))
+		}
+	}
+}
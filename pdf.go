@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pdfInfo describes a PDF document. Sizes are in points.
+type pdfInfo struct {
+	Version   string    `json:"pdf_version"`
+	PageCount int       `json:"page_count"`
+	Pages     []pdfPage `json:"pages"`
+	Encrypted bool      `json:"encrypted"`
+	Title     string    `json:"title,omitempty"`
+	Author    string    `json:"author,omitempty"`
+	Creator   string    `json:"creator,omitempty"`
+	Producer  string    `json:"producer,omitempty"`
+	Created   time.Time `json:"created"`
+	Modified  time.Time `json:"modified"`
+}
+
+type pdfPage struct {
+	Width    float64 `json:"width"`
+	Height   float64 `json:"height"`
+	Rotation int     `json:"rotation"`
+}
+
+// defaultMediaBox is US Letter, which readers assume for pages without one.
+var defaultMediaBox = []interface{}{0.0, 0.0, 612.0, 792.0}
+
+var (
+	pdfInfoPageRegexp  = regexp.MustCompile("(?m)^Page\\s+(\\d+)?\\s*(size|rot):\\s+([\\d.]+)(?: x ([\\d.]+))?")
+	pdfInfoFieldRegexp = regexp.MustCompile("(?m)^(Title|Author|Creator|Producer|CreationDate|ModDate|Pages|Encrypted|PDF version):\\s*(.*)$")
+	pdfDateRegexp      = regexp.MustCompile("^(?:D:)?(\\d{4})(\\d{2})?(\\d{2})?(\\d{2})?(\\d{2})?(\\d{2})?(?:([Zz+-])(\\d{2})?'?(\\d{2})?'?)?")
+)
+
+// inspectPDF reads filename natively, or with pdfinfo when PDF_INFO_PATH
+// names the command to use. PDFs the native parser cannot read are handed
+// to pdfinfo as well.
+func inspectPDF(filename string) (pdfInfo, error) {
+	if bin := os.Getenv("PDF_INFO_PATH"); bin != "" {
+		return inspectPDFWithPdfinfo(bin, filename)
+	}
+	info, err := inspectPDFNatively(filename)
+	if err != nil {
+		if fallback, ferr := inspectPDFWithPdfinfo("pdfinfo", filename); ferr == nil {
+			return fallback, nil
+		}
+	}
+	return info, err
+}
+
+// pdfSize is the size of the first page in whole points.
+func pdfSize(filename string) (int, int, error) {
+	info, err := inspectPDF(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	return info.size()
+}
+
+func (info pdfInfo) size() (int, int, error) {
+	if len(info.Pages) == 0 {
+		return 0, 0, errors.New("PDF has no pages")
+	}
+	return int(math.Round(info.Pages[0].Width)), int(math.Round(info.Pages[0].Height)), nil
+}
+
+func inspectPDFNatively(filename string) (pdfInfo, error) {
+	doc, err := readPDF(filename)
+	if err != nil {
+		return pdfInfo{}, err
+	}
+	info := pdfInfo{Version: doc.version, Pages: []pdfPage{}}
+	root := doc.dict(doc.trailer["Root"])
+	if v, ok := doc.resolve(root["Version"]).(pdfName); ok && string(v) > info.Version {
+		info.Version = string(v)
+	}
+	_, info.Encrypted = doc.trailer["Encrypt"]
+	err = doc.pages(func(page pdfDict) {
+		box, ok := doc.resolve(page["MediaBox"]).([]interface{})
+		if !ok || len(box) != 4 {
+			box = defaultMediaBox
+		}
+		var c [4]float64
+		for i, v := range box {
+			c[i], _ = doc.number(v)
+		}
+		rotate, _ := doc.number(page["Rotate"])
+		info.Pages = append(info.Pages, pdfPage{
+			Width:    math.Abs(c[2] - c[0]),
+			Height:   math.Abs(c[3] - c[1]),
+			Rotation: normalizeRotation(int(rotate)),
+		})
+	})
+	if err != nil {
+		return pdfInfo{}, err
+	}
+	info.PageCount = len(info.Pages)
+	// Strings in encrypted documents are encrypted too.
+	if meta := doc.dict(doc.trailer["Info"]); meta != nil && !info.Encrypted {
+		info.Title = doc.text(meta["Title"])
+		info.Author = doc.text(meta["Author"])
+		info.Creator = doc.text(meta["Creator"])
+		info.Producer = doc.text(meta["Producer"])
+		info.Created, _ = parsePDFDate(doc.text(meta["CreationDate"]))
+		info.Modified, _ = parsePDFDate(doc.text(meta["ModDate"]))
+	}
+	return info, nil
+}
+
+// inspectPDFWithPdfinfo asks pdfinfo for every page and ISO dates. Older
+// versions that ignore -f and -l report only the first page's size, and
+// dates in other formats are left out as their zone is ambiguous.
+func inspectPDFWithPdfinfo(bin, filename string) (pdfInfo, error) {
+	out, err := exec.Command(bin, "-isodates", "-f", "1", "-l", strconv.Itoa(math.MaxInt32), filename).Output()
+	if err != nil {
+		return pdfInfo{}, err
+	}
+	info := pdfInfo{Pages: []pdfPage{}}
+	for _, m := range pdfInfoFieldRegexp.FindAllStringSubmatch(string(out), -1) {
+		v := strings.TrimSpace(m[2])
+		switch m[1] {
+		case "Title":
+			info.Title = v
+		case "Author":
+			info.Author = v
+		case "Creator":
+			info.Creator = v
+		case "Producer":
+			info.Producer = v
+		case "CreationDate":
+			info.Created, _ = time.Parse(time.RFC3339, v)
+		case "ModDate":
+			info.Modified, _ = time.Parse(time.RFC3339, v)
+		case "Pages":
+			info.PageCount, _ = strconv.Atoi(v)
+		case "Encrypted":
+			info.Encrypted = strings.HasPrefix(v, "yes")
+		case "PDF version":
+			info.Version = v
+		}
+	}
+	index := map[int]int{}
+	for _, m := range pdfInfoPageRegexp.FindAllStringSubmatch(string(out), -1) {
+		n := 1
+		if m[1] != "" {
+			n, _ = strconv.Atoi(m[1])
+		}
+		i, ok := index[n]
+		if !ok {
+			i = len(info.Pages)
+			index[n] = i
+			info.Pages = append(info.Pages, pdfPage{})
+		}
+		switch m[2] {
+		case "size":
+			info.Pages[i].Width, _ = strconv.ParseFloat(m[3], 64)
+			info.Pages[i].Height, _ = strconv.ParseFloat(m[4], 64)
+		case "rot":
+			r, _ := strconv.Atoi(m[3])
+			info.Pages[i].Rotation = normalizeRotation(r)
+		}
+	}
+	if len(info.Pages) == 0 || info.Pages[0].Width == 0 {
+		return pdfInfo{}, errors.New("Invalid pdfinfo output")
+	}
+	return info, nil
+}
+
+func normalizeRotation(r int) int {
+	r = (r%360 + 360) % 360
+	return r - r%90
+}
+
+// parsePDFDate reads dates like "D:20161021125228+09'00'", in which every
+// part after the year is optional.
+func parsePDFDate(s string) (time.Time, bool) {
+	m := pdfDateRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return time.Time{}, false
+	}
+	n := make([]int, 6)
+	for i, def := range []int{0, 1, 1, 0, 0, 0} {
+		n[i] = def
+		if m[i+1] != "" {
+			n[i], _ = strconv.Atoi(m[i+1])
+		}
+	}
+	loc := time.UTC
+	if m[7] == "+" || m[7] == "-" {
+		h, _ := strconv.Atoi(m[8])
+		min, _ := strconv.Atoi(m[9])
+		offset := h*3600 + min*60
+		if m[7] == "-" {
+			offset = -offset
+		}
+		loc = time.FixedZone("", offset)
+	}
+	return time.Date(n[0], time.Month(n[1]), n[2], n[3], n[4], n[5], 0, loc), true
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// pdfOptions tunes the PDF export. Unset fields keep LibreOffice's defaults.
+type pdfOptions struct {
+	PageRange          string `json:"page_range,omitempty"`
+	Quality            *int   `json:"quality,omitempty"`
+	MaxImageResolution *int   `json:"max_image_resolution,omitempty"`
+	PDFA               string `json:"pdfa,omitempty"`
+	Tagged             *bool  `json:"tagged,omitempty"`
+	ExportNotesPages   *bool  `json:"export_notes_pages,omitempty"`
+	ExportHiddenSlides *bool  `json:"export_hidden_slides,omitempty"`
+	Bookmarks          *bool  `json:"bookmarks,omitempty"`
+}
+
+// UnmarshalJSON rejects options we do not know so typos fail the request
+// instead of being silently ignored.
+func (o *pdfOptions) UnmarshalJSON(data []byte) error {
+	type plain pdfOptions
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var v plain
+	if err := decoder.Decode(&v); err != nil {
+		return fmt.Errorf("Invalid pdf_options: %v", strings.TrimPrefix(err.Error(), "json: "))
+	}
+	*o = pdfOptions(v)
+	return nil
+}
+
+var (
+	pageRangeRegexp = regexp.MustCompile("^\\d+(-\\d*)?(,\\d+(-\\d*)?)*$")
+	// pdfaVersions maps conformance levels to SelectPdfVersion values.
+	pdfaVersions     = map[string]int{"1b": 1, "2b": 2}
+	imageResolutions = []int{75, 150, 300, 600, 1200}
+)
+
+func validatePDFOptions(o *pdfOptions, outputs []string) error {
+	if o == nil {
+		return nil
+	}
+	if !contains(outputs, "pdf") {
+		return errors.New("pdf_options given, but the pdf output was not requested")
+	}
+	if o.PageRange != "" && !pageRangeRegexp.MatchString(o.PageRange) {
+		return fmt.Errorf("Invalid page_range %q, expected e.g. \"1-3,5\"", o.PageRange)
+	}
+	if o.Quality != nil && (*o.Quality < 1 || *o.Quality > 100) {
+		return errors.New("quality must be between 1 and 100")
+	}
+	if o.MaxImageResolution != nil && !containsInt(imageResolutions, *o.MaxImageResolution) {
+		return fmt.Errorf("max_image_resolution must be one of %v", imageResolutions)
+	}
+	if _, ok := pdfaVersions[o.PDFA]; o.PDFA != "" && !ok {
+		return fmt.Errorf("Unknown pdfa %q, expected 1b or 2b", o.PDFA)
+	}
+	return nil
+}
+
+type filterProperty struct {
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+// filterOptions renders the options in the JSON syntax LibreOffice accepts
+// after the filter name in --convert-to, or "" when nothing is set.
+func (o *pdfOptions) filterOptions() string {
+	if o == nil {
+		return ""
+	}
+	props := map[string]filterProperty{}
+	if o.PageRange != "" {
+		props["PageRange"] = filterProperty{"string", o.PageRange}
+	}
+	if o.Quality != nil {
+		props["Quality"] = filterProperty{"long", *o.Quality}
+	}
+	if o.MaxImageResolution != nil {
+		props["ReduceImageResolution"] = filterProperty{"boolean", true}
+		props["MaxImageResolution"] = filterProperty{"long", *o.MaxImageResolution}
+	}
+	if v, ok := pdfaVersions[o.PDFA]; ok {
+		props["SelectPdfVersion"] = filterProperty{"long", v}
+	}
+	for name, b := range map[string]*bool{
+		"UseTaggedPDF":       o.Tagged,
+		"ExportNotesPages":   o.ExportNotesPages,
+		"ExportHiddenSlides": o.ExportHiddenSlides,
+		"ExportBookmarks":    o.Bookmarks,
+	} {
+		if b != nil {
+			props[name] = filterProperty{"boolean", *b}
+		}
+	}
+	if len(props) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(props)
+	return string(b)
+}
+
+func containsInt(list []int, v int) bool {
+	for _, i := range list {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
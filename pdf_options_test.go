@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPDFOptionsFilterOptions(t *testing.T) {
+	for _, test := range []struct {
+		expected string
+		json     string
+	}{
+		{"", `{}`},
+		{`{"PageRange":{"type":"string","value":"2-3"}}`, `{"page_range":"2-3"}`},
+		{`{"MaxImageResolution":{"type":"long","value":300},"Quality":{"type":"long","value":70},"ReduceImageResolution":{"type":"boolean","value":true}}`, `{"quality":70,"max_image_resolution":300}`},
+		{`{"ExportBookmarks":{"type":"boolean","value":false},"SelectPdfVersion":{"type":"long","value":2},"UseTaggedPDF":{"type":"boolean","value":true}}`, `{"pdfa":"2b","tagged":true,"bookmarks":false}`},
+		{`{"ExportHiddenSlides":{"type":"boolean","value":true},"ExportNotesPages":{"type":"boolean","value":true}}`, `{"export_notes_pages":true,"export_hidden_slides":true}`},
+	} {
+		var o pdfOptions
+		if err := json.Unmarshal([]byte(test.json), &o); err != nil {
+			t.Errorf("Expected nil but got %v", err)
+		}
+		if actual := o.filterOptions(); actual != test.expected {
+			t.Errorf("Expected %v but got %v", test.expected, actual)
+		}
+	}
+}
+
+func TestPDFOptionsUnknownField(t *testing.T) {
+	var o pdfOptions
+	expected := `Invalid pdf_options: unknown field "pages"`
+	if err := json.Unmarshal([]byte(`{"pages":"1-2"}`), &o); err == nil || err.Error() != expected {
+		t.Errorf("Expected %v but got %v", expected, err)
+	}
+
+	w := httptest.NewRecorder()
+	handleConvertRequest(w, httptest.NewRequest("POST", "/", strings.NewReader(`{"bucket":"test-bucket","key":"foo.pptx","pdf_options":{"pages":"1-2"}}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected %v but got %v", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestValidatePDFOptions(t *testing.T) {
+	quality := 0
+	resolution := 200
+	for _, test := range []struct {
+		expected string
+		options  *pdfOptions
+		outputs  []string
+	}{
+		{"", nil, []string{"docx"}},
+		{"", &pdfOptions{PageRange: "1-3,5,7-"}, []string{"pdf"}},
+		{"pdf_options given, but the pdf output was not requested", &pdfOptions{}, []string{"docx"}},
+		{`Invalid page_range "1;3", expected e.g. "1-3,5"`, &pdfOptions{PageRange: "1;3"}, []string{"pdf"}},
+		{"quality must be between 1 and 100", &pdfOptions{Quality: &quality}, []string{"pdf"}},
+		{"max_image_resolution must be one of [75 150 300 600 1200]", &pdfOptions{MaxImageResolution: &resolution}, []string{"pdf"}},
+		{`Unknown pdfa "3a", expected 1b or 2b`, &pdfOptions{PDFA: "3a"}, []string{"pdf"}},
+	} {
+		actual := ""
+		if err := validatePDFOptions(test.options, test.outputs); err != nil {
+			actual = err.Error()
+		}
+		if actual != test.expected {
+			t.Errorf("Expected %v but got %v", test.expected, actual)
+		}
+	}
+}
+
+func TestRequestConversionPDFOptions(t *testing.T) {
+	req := requestPayload{Key: "foo.pptx", PDFOptions: &pdfOptions{PageRange: "2-3"}}
+	c := req.conversion(outputFormats["pdf"])
+	expected := `pdf:impress_pdf_Export:{"PageRange":{"type":"string","value":"2-3"}}`
+	if c.target() != expected || !c.custom() {
+		t.Errorf("Expected %v but got %v", expected, c.target())
+	}
+	if c := req.conversion(outputFormats["html"]); c.Options != "" || c.custom() {
+		t.Errorf("Expected no options but got %v", c.Options)
+	}
+}
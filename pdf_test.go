@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func writeTestPDF(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "inspect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
+}
+
+const testPDF = `%PDF-1.4
+%âãÏÓ
+1 0 obj
+<< /Type /Catalog /Pages 2 0 R /Version /1.6 >>
+endobj
+2 0 obj
+<< /Type /Pages /Kids [3 0 R 4 0 R] /Count 2 /MediaBox [0 0 595.28 841.89] /Rotate 90 >>
+endobj
+3 0 obj
+<< /Type /Page /Parent 2 0 R /Contents 5 0 R >>
+endobj
+4 0 obj
+<< /Type /Page /Parent 2 0 R /MediaBox [0 0 792 612] /Rotate -90 >>
+endobj
+5 0 obj
+<< /Length 8 >>
+stream
+1 0 obj
+endstream
+endobj
+6 0 obj
+<< /Title <FEFF00C9007400E9> /Author (sata \(ngs\)\051) /Creator (Writer) /Producer (LibreOffice\0406.4) >>
+endobj
+xref
+0 7
+trailer
+<< /Size 7 /Root 1 0 R /Info 6 0 R >>
+startxref
+0
+%%EOF
+`
+
+func TestInspectPDFNatively(t *testing.T) {
+	filename := writeTestPDF(t, testPDF)
+	defer os.Remove(filename)
+	expected := pdfInfo{
+		Version:   "1.6",
+		PageCount: 2,
+		Pages:     []pdfPage{{595.28, 841.89, 90}, {792, 612, 270}},
+		Title:     "Été",
+		Author:    "sata (ngs))",
+		Creator:   "Writer",
+		Producer:  "LibreOffice 6.4",
+	}
+	actual, err := inspectPDFNatively(filename)
+	if err != nil || !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected %v but got %v %v", expected, actual, err)
+	}
+}
+
+func TestInspectPDFNativelyObjectStream(t *testing.T) {
+	objects := "<< /Type /Pages /Kids [3 0 R] /Count 1 >> << /Type /Page /Parent 2 0 R /MediaBox [0 0 200 100] >>"
+	header := "2 0 3 42 "
+	var compressed bytes.Buffer
+	w := zlib.NewWriter(&compressed)
+	w.Write([]byte(header + objects))
+	w.Close()
+	content := fmt.Sprintf("%%PDF-1.5\n1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n"+
+		"4 0 obj\n<< /Type /ObjStm /N 2 /First %d /Filter /FlateDecode /Length %d >>\nstream\n%s\nendstream\nendobj\n"+
+		"5 0 obj\n<< /Type /XRef /Root 1 0 R /Encrypt 6 0 R /Length 0 >>\nstream\n\nendstream\nendobj\nstartxref\n0\n%%%%EOF\n",
+		len(header), compressed.Len(), compressed.String())
+	filename := writeTestPDF(t, content)
+	defer os.Remove(filename)
+	expected := pdfInfo{
+		Version:   "1.5",
+		PageCount: 1,
+		Pages:     []pdfPage{{200, 100, 0}},
+		Encrypted: true,
+	}
+	actual, err := inspectPDFNatively(filename)
+	if err != nil || !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected %v but got %v %v", expected, actual, err)
+	}
+}
+
+func TestInspectPDFNativelyErrors(t *testing.T) {
+	for _, test := range []struct {
+		expected string
+		content  string
+	}{
+		{"Not a PDF file", "PK\x03\x04"},
+		{"PDF has no document catalog", "%PDF-1.4\n1 0 obj\n<< /Type /Pages >>\nendobj\n"},
+		{"PDF page tree contains a cycle", "%PDF-1.4\n1 0 obj\n<< /Pages 2 0 R >>\nendobj\n2 0 obj\n<< /Type /Pages /Kids [2 0 R] >>\nendobj\ntrailer\n<< /Root 1 0 R >>\n"},
+	} {
+		filename := writeTestPDF(t, test.content)
+		defer os.Remove(filename)
+		if _, err := inspectPDFNatively(filename); err == nil || err.Error() != test.expected {
+			t.Errorf("Expected %v but got %v", test.expected, err)
+		}
+	}
+}
+
+func TestInspectPDFNativelyNegativeOffsets(t *testing.T) {
+	for _, test := range []struct {
+		expected string
+		content  string
+	}{
+		{"PDF has no document catalog", "%PDF-1.4\n1 0 obj\n<< /Length -20 >>\nstream\nxx\nendstream\nendobj\ntrailer\n<< /Root 1 0 R >>\n"},
+		{"<nil>", "%PDF-1.5\n1 0 obj\n<< /Pages 2 0 R >>\nendobj\n3 0 obj\n<< /Type /ObjStm /N 1 /First -4 /Length 4 >>\nstream\n2 0 \nendstream\nendobj\ntrailer\n<< /Root 1 0 R >>\n"},
+		{"<nil>", "%PDF-1.5\n1 0 obj\n<< /Pages 2 0 R >>\nendobj\n3 0 obj\n<< /Type /ObjStm /N 1 /First 6 /Length 6 >>\nstream\n2 -6 \nendstream\nendobj\ntrailer\n<< /Root 1 0 R >>\n"},
+		{"<nil>", "%PDF-1.5\n1 0 obj\n<< /Pages 2 0 R >>\nendobj\n3 0 obj\n<< /Type /ObjStm /N 1 /First NaN /Length 4 >>\nstream\n2 0 \nendstream\nendobj\ntrailer\n<< /Root 1 0 R >>\n"},
+		{"<nil>", "%PDF-1.5\n1 0 obj\n<< /Pages 2 0 R >>\nendobj\n3 0 obj\n<< /Type /ObjStm /N 1 /First 4 /Length 8 >>\nstream\n2 NaN \nendstream\nendobj\ntrailer\n<< /Root 1 0 R >>\n"},
+		{"<nil>", "%PDF-1.5\n1 0 obj\n<< /Pages 2 0 R >>\nendobj\n3 0 obj\n<< /Type /ObjStm /N 1 /First 0.5 /Length 8 >>\nstream\n2 Inf \nendstream\nendobj\ntrailer\n<< /Root 1 0 R >>\n"},
+	} {
+		filename := writeTestPDF(t, test.content)
+		defer os.Remove(filename)
+		if _, err := inspectPDFNatively(filename); fmt.Sprint(err) != test.expected {
+			t.Errorf("Expected %v but got %v", test.expected, err)
+		}
+	}
+}
+
+func TestInspectPDFFallsBackToPdfinfo(t *testing.T) {
+	orig, origPath := os.Getenv("PDF_INFO_PATH"), os.Getenv("PATH")
+	defer os.Setenv("PDF_INFO_PATH", orig)
+	defer os.Setenv("PATH", origPath)
+	os.Unsetenv("PDF_INFO_PATH")
+	mocks, _ := filepath.Abs("mock-commands")
+	os.Setenv("PATH", mocks+string(os.PathListSeparator)+origPath)
+	filename := writeTestPDF(t, "%PDF-1.4\n")
+	defer os.Remove(filename)
+	info, err := inspectPDF(filename)
+	if err != nil || info.PageCount != 15 {
+		t.Errorf("Expected 15 pages but got %v %v", info.PageCount, err)
+	}
+}
+
+func TestPDFSizeNatively(t *testing.T) {
+	orig := os.Getenv("PDF_INFO_PATH")
+	defer os.Setenv("PDF_INFO_PATH", orig)
+	os.Unsetenv("PDF_INFO_PATH")
+	filename := writeTestPDF(t, testPDF)
+	defer os.Remove(filename)
+	w, h, err := pdfSize(filename)
+	if err != nil || w != 595 || h != 842 {
+		t.Errorf("Expected 595 842 but got %v %v %v", w, h, err)
+	}
+}
+
+func TestInspectPDFWithPdfinfo(t *testing.T) {
+	expected := pdfInfo{
+		Version:   "1.4",
+		PageCount: 15,
+		Pages:     []pdfPage{{842, 595, 0}},
+		Author:    "sata",
+		Creator:   "Calc",
+		Producer:  "LibreOffice 5.0",
+	}
+	actual, err := inspectPDFWithPdfinfo("mock-commands/pdfinfo", "/tmp/foo")
+	if err != nil || !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected %v but got %v %v", expected, actual, err)
+	}
+
+	script := writeTestPDF(t, "#!/bin/sh\necho 'Pages:          2\nEncrypted:      yes (print:yes copy:no)\n"+
+		"Page    1 size: 612 x 792 pts (letter)\nPage    1 rot:  0\nPage    2 size: 595.276 x 841.89 pts (A4)\nPage    2 rot:  90'\n")
+	defer os.Remove(script)
+	os.Chmod(script, 0755)
+	expected = pdfInfo{
+		PageCount: 2,
+		Pages:     []pdfPage{{612, 792, 0}, {595.276, 841.89, 90}},
+		Encrypted: true,
+	}
+	actual, err = inspectPDFWithPdfinfo(script, "/tmp/foo")
+	if err != nil || !reflect.DeepEqual(expected, actual) {
+		t.Errorf("Expected %v but got %v %v", expected, actual, err)
+	}
+}
+
+func TestParsePDFDate(t *testing.T) {
+	for _, test := range []struct {
+		expected string
+		date     string
+	}{
+		{"2016-10-21T12:52:28+09:00", "D:20161021125228+09'00'"},
+		{"2016-10-21T12:52:28-05:30", "D:20161021125228-05'30"},
+		{"2016-10-21T12:52:28Z", "D:20161021125228Z"},
+		{"2016-10-01T00:00:00Z", "D:201610"},
+		{"2016-10-21T12:52:28Z", "20161021125228"},
+	} {
+		d, ok := parsePDFDate(test.date)
+		if actual := d.Format(time.RFC3339); !ok || actual != test.expected {
+			t.Errorf("Expected %v but got %v", test.expected, actual)
+		}
+	}
+	if _, ok := parsePDFDate("yesterday"); ok {
+		t.Errorf("Expected false but got true")
+	}
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"strconv"
+	"unicode/utf16"
+)
+
+// The native PDF reader does not follow the cross-reference table, which is
+// often damaged in the wild. It scans the file for indirect objects instead,
+// letting later definitions win as incremental updates do, and unpacks
+// object streams. That is enough to walk the page tree and read the
+// document information dictionary.
+
+type (
+	pdfName   string
+	pdfString string
+	pdfDict   map[string]interface{}
+	pdfRef    struct{ Num, Gen int }
+	pdfStream struct {
+		Dict pdfDict
+		Data []byte
+	}
+)
+
+type pdfDocument struct {
+	objects map[int]interface{}
+	trailer pdfDict
+	version string
+}
+
+var (
+	errNotPDF        = errors.New("Not a PDF file")
+	pdfHeaderRegexp  = regexp.MustCompile("%PDF-(\\d\\.\\d)")
+	pdfObjRegexp     = regexp.MustCompile("(\\d+)\\s+(\\d+)\\s+obj\\b")
+	pdfTrailerRegexp = regexp.MustCompile("trailer\\s*<<")
+	// PDF numbers have no exponent, and no NaN or infinity either.
+	pdfNumberRegexp = regexp.MustCompile("^[+-]?([0-9]+\\.?[0-9]*|\\.[0-9]+)$")
+)
+
+// maxPageTreeDepth guards against page trees that loop back on themselves.
+const maxPageTreeDepth = 64
+
+func readPDF(filename string) (*pdfDocument, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parsePDF(b)
+}
+
+func parsePDF(b []byte) (*pdfDocument, error) {
+	head := b
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	m := pdfHeaderRegexp.FindSubmatch(head)
+	if m == nil {
+		return nil, errNotPDF
+	}
+	doc := &pdfDocument{objects: map[int]interface{}{}, trailer: pdfDict{}, version: string(m[1])}
+	var objStms []pdfStream
+	for pos := 0; pos < len(b); {
+		loc := pdfObjRegexp.FindSubmatchIndex(b[pos:])
+		if loc == nil {
+			break
+		}
+		num, _ := strconv.Atoi(string(b[pos+loc[2] : pos+loc[3]]))
+		l := &pdfLexer{b: b, pos: pos + loc[1]}
+		obj, err := l.object()
+		if err != nil {
+			pos += loc[1]
+			continue
+		}
+		doc.objects[num] = obj
+		if s, ok := obj.(pdfStream); ok {
+			switch s.Dict["Type"] {
+			case pdfName("ObjStm"):
+				objStms = append(objStms, s)
+			case pdfName("XRef"):
+				doc.mergeTrailer(s.Dict)
+			}
+		}
+		pos = l.pos
+	}
+	for _, loc := range pdfTrailerRegexp.FindAllIndex(b, -1) {
+		l := &pdfLexer{b: b, pos: loc[1] - 2}
+		if d, err := l.object(); err == nil {
+			if d, ok := d.(pdfDict); ok {
+				doc.mergeTrailer(d)
+			}
+		}
+	}
+	for _, s := range objStms {
+		doc.unpackObjectStream(s)
+	}
+	if _, ok := doc.trailer["Root"]; !ok {
+		return nil, errors.New("PDF has no document catalog")
+	}
+	return doc, nil
+}
+
+func (doc *pdfDocument) mergeTrailer(d pdfDict) {
+	for _, k := range []string{"Root", "Info", "Encrypt"} {
+		if v, ok := d[k]; ok {
+			doc.trailer[k] = v
+		}
+	}
+}
+
+// unpackObjectStream adds the objects compressed in s that are not defined
+// directly in the file.
+func (doc *pdfDocument) unpackObjectStream(s pdfStream) {
+	data, err := s.decode()
+	if err != nil {
+		return
+	}
+	n, _ := doc.resolve(s.Dict["N"]).(float64)
+	first, _ := doc.resolve(s.Dict["First"]).(float64)
+	if first < 0 || first != math.Trunc(first) || first > float64(len(data)) {
+		return
+	}
+	l := &pdfLexer{b: data}
+	for i := 0; i < int(n); i++ {
+		num, err1 := l.object()
+		offset, err2 := l.object()
+		num1, ok1 := num.(float64)
+		offset1, ok2 := offset.(float64)
+		if err1 != nil || err2 != nil || !ok1 || !ok2 || offset1 < 0 || offset1 != math.Trunc(offset1) || first+offset1 > float64(len(data)) {
+			return
+		}
+		if _, ok := doc.objects[int(num1)]; ok {
+			continue
+		}
+		ol := &pdfLexer{b: data, pos: int(first) + int(offset1)}
+		if obj, err := ol.object(); err == nil {
+			doc.objects[int(num1)] = obj
+		}
+	}
+}
+
+func (s pdfStream) decode() ([]byte, error) {
+	switch f := s.Dict["Filter"].(type) {
+	case nil:
+		return s.Data, nil
+	case pdfName:
+		if f == "FlateDecode" {
+			r, err := zlib.NewReader(bytes.NewReader(s.Data))
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			return ioutil.ReadAll(r)
+		}
+	case []interface{}:
+		if len(f) == 1 {
+			return pdfStream{Dict: pdfDict{"Filter": f[0]}, Data: s.Data}.decode()
+		}
+	}
+	return nil, fmt.Errorf("Unsupported stream filter %v", s.Dict["Filter"])
+}
+
+// resolve follows references until it reaches a direct object. Missing
+// objects resolve to nil, as the PDF specification requires.
+func (doc *pdfDocument) resolve(v interface{}) interface{} {
+	for i := 0; i < 32; i++ {
+		ref, ok := v.(pdfRef)
+		if !ok {
+			return v
+		}
+		v = doc.objects[ref.Num]
+	}
+	return nil
+}
+
+func (doc *pdfDocument) dict(v interface{}) pdfDict {
+	switch d := doc.resolve(v).(type) {
+	case pdfDict:
+		return d
+	case pdfStream:
+		return d.Dict
+	}
+	return nil
+}
+
+func (doc *pdfDocument) number(v interface{}) (float64, bool) {
+	f, ok := doc.resolve(v).(float64)
+	return f, ok
+}
+
+// pages walks the page tree in document order, passing each page with the
+// attributes it inherits from its ancestors.
+func (doc *pdfDocument) pages(fn func(page pdfDict)) error {
+	root := doc.dict(doc.trailer["Root"])
+	if root == nil {
+		return errors.New("PDF has no document catalog")
+	}
+	seen := map[pdfRef]bool{}
+	var walk func(v interface{}, inherited pdfDict, depth int) error
+	walk = func(v interface{}, inherited pdfDict, depth int) error {
+		if ref, ok := v.(pdfRef); ok {
+			if seen[ref] {
+				return errors.New("PDF page tree contains a cycle")
+			}
+			seen[ref] = true
+		}
+		if depth > maxPageTreeDepth {
+			return errors.New("PDF page tree is too deep")
+		}
+		node := doc.dict(v)
+		if node == nil {
+			return nil
+		}
+		attrs := pdfDict{}
+		for k, v := range inherited {
+			attrs[k] = v
+		}
+		for _, k := range []string{"MediaBox", "CropBox", "Rotate"} {
+			if v, ok := node[k]; ok {
+				attrs[k] = v
+			}
+		}
+		kids, isTree := doc.resolve(node["Kids"]).([]interface{})
+		if !isTree || node["Type"] == pdfName("Page") {
+			fn(attrs)
+			return nil
+		}
+		for _, kid := range kids {
+			if err := walk(kid, attrs, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(root["Pages"], pdfDict{}, 0)
+}
+
+// text decodes a text string, which is UTF-16BE when it starts with a byte
+// order mark and PDFDocEncoding, approximated by Latin-1, otherwise.
+func (doc *pdfDocument) text(v interface{}) string {
+	s, ok := doc.resolve(v).(pdfString)
+	if !ok {
+		return ""
+	}
+	b := []byte(s)
+	if len(b) >= 2 && b[0] == 0xfe && b[1] == 0xff {
+		u := make([]uint16, 0, len(b)/2)
+		for i := 2; i+1 < len(b); i += 2 {
+			u = append(u, uint16(b[i])<<8|uint16(b[i+1]))
+		}
+		return string(utf16.Decode(u))
+	}
+	if len(b) >= 3 && b[0] == 0xef && b[1] == 0xbb && b[2] == 0xbf {
+		return string(b[3:])
+	}
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
+
+type pdfLexer struct {
+	b   []byte
+	pos int
+}
+
+var errPDFSyntax = errors.New("PDF syntax error")
+
+func isPDFSpace(c byte) bool {
+	return c == 0 || c == '\t' || c == '\n' || c == '\f' || c == '\r' || c == ' '
+}
+
+func isPDFDelimiter(c byte) bool {
+	return bytes.IndexByte([]byte("()<>[]{}/%"), c) >= 0
+}
+
+func (l *pdfLexer) skipSpace() {
+	for l.pos < len(l.b) {
+		c := l.b[l.pos]
+		if c == '%' {
+			for l.pos < len(l.b) && l.b[l.pos] != '\n' && l.b[l.pos] != '\r' {
+				l.pos++
+			}
+			continue
+		}
+		if !isPDFSpace(c) {
+			return
+		}
+		l.pos++
+	}
+}
+
+func (l *pdfLexer) hasPrefix(s string) bool {
+	return bytes.HasPrefix(l.b[l.pos:], []byte(s))
+}
+
+// token reads a run of regular characters, such as a number or keyword.
+func (l *pdfLexer) token() string {
+	start := l.pos
+	for l.pos < len(l.b) && !isPDFSpace(l.b[l.pos]) && !isPDFDelimiter(l.b[l.pos]) {
+		l.pos++
+	}
+	return string(l.b[start:l.pos])
+}
+
+func (l *pdfLexer) object() (interface{}, error) {
+	l.skipSpace()
+	if l.pos >= len(l.b) {
+		return nil, errPDFSyntax
+	}
+	switch c := l.b[l.pos]; {
+	case c == '/':
+		l.pos++
+		return pdfName(decodePDFName(l.token())), nil
+	case c == '(':
+		return l.literalString()
+	case l.hasPrefix("<<"):
+		return l.dictOrStream()
+	case c == '<':
+		return l.hexString()
+	case c == '[':
+		l.pos++
+		var a []interface{}
+		for {
+			l.skipSpace()
+			if l.pos >= len(l.b) {
+				return nil, errPDFSyntax
+			}
+			if l.b[l.pos] == ']' {
+				l.pos++
+				return a, nil
+			}
+			v, err := l.object()
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+	}
+	tok := l.token()
+	switch tok {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	case "":
+		return nil, errPDFSyntax
+	}
+	if !pdfNumberRegexp.MatchString(tok) {
+		return nil, errPDFSyntax
+	}
+	n, err := strconv.ParseFloat(tok, 64)
+	if err != nil {
+		return nil, errPDFSyntax
+	}
+	if ref, ok := l.reference(tok); ok {
+		return ref, nil
+	}
+	return n, nil
+}
+
+// reference completes "num gen R" when num has just been read.
+func (l *pdfLexer) reference(num string) (pdfRef, bool) {
+	save := l.pos
+	n, err1 := strconv.Atoi(num)
+	l.skipSpace()
+	g, err2 := strconv.Atoi(l.token())
+	l.skipSpace()
+	if err1 == nil && err2 == nil && l.token() == "R" {
+		return pdfRef{n, g}, true
+	}
+	l.pos = save
+	return pdfRef{}, false
+}
+
+func (l *pdfLexer) dictOrStream() (interface{}, error) {
+	l.pos += 2
+	d := pdfDict{}
+	for {
+		l.skipSpace()
+		if l.pos >= len(l.b) {
+			return nil, errPDFSyntax
+		}
+		if l.hasPrefix(">>") {
+			l.pos += 2
+			break
+		}
+		k, err := l.object()
+		if err != nil {
+			return nil, err
+		}
+		name, ok := k.(pdfName)
+		if !ok {
+			return nil, errPDFSyntax
+		}
+		v, err := l.object()
+		if err != nil {
+			return nil, err
+		}
+		d[string(name)] = v
+	}
+	save := l.pos
+	l.skipSpace()
+	if !l.hasPrefix("stream") {
+		l.pos = save
+		return d, nil
+	}
+	l.pos += len("stream")
+	if l.hasPrefix("\r\n") {
+		l.pos += 2
+	} else if l.hasPrefix("\n") || l.hasPrefix("\r") {
+		l.pos++
+	}
+	start := l.pos
+	n, ok := d["Length"].(float64)
+	if ok && n < 0 {
+		return nil, errPDFSyntax
+	}
+	// Trust a direct /Length only when endstream follows it.
+	if ok && n <= float64(len(l.b)-start) {
+		l.pos = start + int(n)
+		l.skipSpace()
+		if l.hasPrefix("endstream") {
+			data := l.b[start : start+int(n)]
+			l.pos += len("endstream")
+			return pdfStream{Dict: d, Data: data}, nil
+		}
+	}
+	end := bytes.Index(l.b[start:], []byte("endstream"))
+	if end < 0 {
+		return nil, errPDFSyntax
+	}
+	data := bytes.TrimRight(l.b[start:start+end], "\r\n")
+	l.pos = start + end + len("endstream")
+	return pdfStream{Dict: d, Data: data}, nil
+}
+
+func (l *pdfLexer) literalString() (interface{}, error) {
+	l.pos++
+	var out []byte
+	depth := 1
+	for l.pos < len(l.b) {
+		c := l.b[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return pdfString(out), nil
+			}
+		case '\\':
+			if l.pos >= len(l.b) {
+				return nil, errPDFSyntax
+			}
+			e := l.b[l.pos]
+			l.pos++
+			switch e {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				if l.pos < len(l.b) && l.b[l.pos] == '\n' {
+					l.pos++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if e >= '0' && e <= '7' {
+					v := int(e - '0')
+					for i := 0; i < 2 && l.pos < len(l.b) && l.b[l.pos] >= '0' && l.b[l.pos] <= '7'; i++ {
+						v = v*8 + int(l.b[l.pos]-'0')
+						l.pos++
+					}
+					c = byte(v)
+				} else {
+					c = e
+				}
+			}
+		}
+		out = append(out, c)
+	}
+	return nil, errPDFSyntax
+}
+
+func (l *pdfLexer) hexString() (interface{}, error) {
+	l.pos++
+	var digits []byte
+	for l.pos < len(l.b) && l.b[l.pos] != '>' {
+		if c := l.b[l.pos]; !isPDFSpace(c) {
+			digits = append(digits, c)
+		}
+		l.pos++
+	}
+	if l.pos >= len(l.b) {
+		return nil, errPDFSyntax
+	}
+	l.pos++
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	out := make([]byte, len(digits)/2)
+	for i := range out {
+		v, err := strconv.ParseUint(string(digits[2*i:2*i+2]), 16, 8)
+		if err != nil {
+			return nil, errPDFSyntax
+		}
+		out[i] = byte(v)
+	}
+	return pdfString(out), nil
+}
+
+func decodePDFName(s string) string {
+	if !bytes.ContainsRune([]byte(s), '#') {
+		return s
+	}
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '#' && i+2 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				out = append(out, byte(v))
+				i += 2
+				continue
+			}
+		}
+		out = append(out, s[i])
+	}
+	return string(out)
+}
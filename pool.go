@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	errQueueFull    = errors.New("Conversion queue is full")
+	errShuttingDown = errors.New("Server is shutting down")
+)
+
+// workerPool runs submitted tasks on a fixed number of goroutines. Tasks wait
+// in a bounded queue; submit never blocks and fails once the queue is full.
+type workerPool struct {
+	tasks   chan func()
+	workers int
+	busy    int32
+	wg      sync.WaitGroup
+	mu      sync.RWMutex
+	closed  bool
+}
+
+type queueStatus struct {
+	Depth    int `json:"depth"`
+	Capacity int `json:"capacity"`
+	Workers  int `json:"workers"`
+	Busy     int `json:"busy"`
+}
+
+var workers = newWorkerPool(envInt("WORKER_COUNT", runtime.NumCPU()), envInt("QUEUE_SIZE", 100))
+
+func newWorkerPool(size int, queueSize int) *workerPool {
+	if size < 1 {
+		size = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	p := &workerPool{
+		tasks:   make(chan func(), queueSize),
+		workers: size,
+	}
+	p.wg.Add(size)
+	for i := 0; i < size; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	defer p.wg.Done()
+	for task := range p.tasks {
+		atomic.AddInt32(&p.busy, 1)
+		task()
+		atomic.AddInt32(&p.busy, -1)
+	}
+}
+
+func (p *workerPool) submit(task func()) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return errShuttingDown
+	}
+	select {
+	case p.tasks <- task:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+// close stops the pool taking tasks. Tasks already queued still run.
+func (p *workerPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		p.closed = true
+		close(p.tasks)
+	}
+}
+
+// accepting reports whether the pool still takes tasks.
+func (p *workerPool) accepting() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return !p.closed
+}
+
+// wait blocks until the workers of a closed pool have run every task, or
+// until ctx is done.
+func (p *workerPool) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *workerPool) status() queueStatus {
+	return queueStatus{
+		Depth:    len(p.tasks),
+		Capacity: cap(p.tasks),
+		Workers:  p.workers,
+		Busy:     int(atomic.LoadInt32(&p.busy)),
+	}
+}
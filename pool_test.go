@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWorkerPoolSubmit(t *testing.T) {
+	p := newWorkerPool(1, 1)
+	release := make(chan bool)
+	started := make(chan bool)
+	p.submit(func() {
+		started <- true
+		<-release
+	})
+	<-started
+	for _, test := range []struct {
+		expected interface{}
+		actual   interface{}
+	}{
+		{nil, p.submit(func() {})},
+		{errQueueFull, p.submit(func() {})},
+		{queueStatus{Depth: 1, Capacity: 1, Workers: 1, Busy: 1}, p.status()},
+	} {
+		if test.expected != test.actual {
+			t.Errorf("Expected %v but got %v", test.expected, test.actual)
+		}
+	}
+	close(release)
+}
+
+func TestHandleConvertRequestQueueFull(t *testing.T) {
+	orig := workers
+	defer func() { workers = orig }()
+	workers = newWorkerPool(1, 1)
+	release := make(chan bool)
+	defer close(release)
+	started := make(chan bool)
+	workers.submit(func() {
+		started <- true
+		<-release
+	})
+	<-started
+	workers.submit(func() {})
+	queued := len(jobs.list(jobQueued))
+
+	w := httptest.NewRecorder()
+	handleConvertRequest(w, httptest.NewRequest("POST", "/", strings.NewReader(`{"bucket":"test-bucket","key":"foo.pptx"}`)))
+	var actual errorResponse
+	json.NewDecoder(w.Body).Decode(&actual)
+	for _, test := range []struct {
+		expected interface{}
+		actual   interface{}
+	}{
+		{http.StatusServiceUnavailable, w.Code},
+		{"30", w.Header().Get("Retry-After")},
+		{"1", w.Header().Get("X-Queue-Depth")},
+		{errQueueFull.Error(), actual.Error},
+		{1, actual.Queue.Busy},
+		{queued, len(jobs.list(jobQueued))},
+	} {
+		if test.expected != test.actual {
+			t.Errorf("Expected %v but got %v", test.expected, test.actual)
+		}
+	}
+}
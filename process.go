@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// timeoutError is returned when a command is killed for running longer than
+// allowed.
+type timeoutError struct {
+	After time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("Conversion timed out after %v", e.After)
+}
+
+func isTimeout(err error) bool {
+	_, ok := err.(*timeoutError)
+	return ok
+}
+
+func killGrace() time.Duration {
+	return time.Second * time.Duration(envInt("CMD_KILL_GRACE_SECONDS", 5))
+}
+
+// runWithTimeout runs cmd in its own process group so the soffice.bin it
+// spawns goes down with it. The group is terminated after
+// CMD_TIMEOUT_SECONDS or when ctx is done.
+func runWithTimeout(ctx context.Context, cmd *exec.Cmd) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	timeout := time.Second * time.Duration(envInt("CMD_TIMEOUT_SECONDS", 60))
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-exited:
+		return err
+	case <-timer.C:
+		terminateGroup(cmd.Process.Pid, exited, killGrace())
+		return &timeoutError{After: timeout}
+	case <-ctx.Done():
+		terminateGroup(cmd.Process.Pid, exited, killGrace())
+		return ctx.Err()
+	}
+}
+
+// terminateGroup asks the process group led by pid to exit and kills it if
+// it is still running after grace. exited receives once the leader is reaped.
+func terminateGroup(pid int, exited <-chan error, grace time.Duration) {
+	syscall.Kill(-pid, syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(grace):
+		syscall.Kill(-pid, syscall.SIGKILL)
+		<-exited
+	}
+	// Children may outlive a leader that exited on SIGTERM.
+	syscall.Kill(-pid, syscall.SIGKILL)
+}
+
+// reapStaleOffices kills LibreOffice processes running with a profile under
+// the work root that no conversion or pooled instance owns any more, such
+// as those left behind by a crashed server. It returns how many it killed.
+func reapStaleOffices(procRoot string) int {
+	entries, err := ioutil.ReadDir(procRoot)
+	if err != nil {
+		return 0
+	}
+	parent := filepath.Join(profiles.root, "profiles") + "/"
+	killed := 0
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		cmdline, err := ioutil.ReadFile(filepath.Join(procRoot, e.Name(), "cmdline"))
+		if err != nil {
+			continue
+		}
+		profile := profileFromArgs(bytes.Split(cmdline, []byte{0}))
+		if !strings.HasPrefix(profile, parent) || profiles.inUse(profile) {
+			continue
+		}
+		if err := syscall.Kill(pid, syscall.SIGKILL); err == nil {
+			log.Printf("Killed stale LibreOffice process %v using %v", pid, profile)
+			killed++
+		}
+	}
+	return killed
+}
+
+func profileFromArgs(args [][]byte) string {
+	for _, arg := range args {
+		s := string(arg)
+		if !strings.HasPrefix(s, "-env:UserInstallation=") {
+			continue
+		}
+		u, err := url.Parse(strings.TrimPrefix(s, "-env:UserInstallation="))
+		if err != nil {
+			return ""
+		}
+		return filepath.Clean(u.Path)
+	}
+	return ""
+}
+
+func startReaper(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			reapStaleOffices("/proc")
+		}
+	}()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// alive reports whether pid is running, treating zombies as gone.
+func alive(pid int) bool {
+	stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(stat))
+	return len(fields) > 2 && fields[2] != "Z"
+}
+
+func waitGone(pid int) bool {
+	for i := 0; i < 50; i++ {
+		if !alive(pid) {
+			return true
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return false
+}
+
+func TestRunWithTimeoutKillsGroup(t *testing.T) {
+	os.Setenv("CMD_TIMEOUT_SECONDS", "1")
+	os.Setenv("CMD_KILL_GRACE_SECONDS", "1")
+	defer os.Unsetenv("CMD_TIMEOUT_SECONDS")
+	defer os.Unsetenv("CMD_KILL_GRACE_SECONDS")
+	pidfile, _ := ioutil.TempFile("", "pid")
+	defer os.Remove(pidfile.Name())
+
+	cmd := exec.Command("sh", "-c", "trap '' TERM; sleep 30 & echo $! > "+pidfile.Name()+"; wait")
+	err := runWithTimeout(context.Background(), cmd)
+	b, _ := ioutil.ReadFile(pidfile.Name())
+	child, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	for _, test := range []struct {
+		expected interface{}
+		actual   interface{}
+	}{
+		{true, isTimeout(err)},
+		{"Conversion timed out after 1s", err.Error()},
+		{true, child > 0},
+		{true, waitGone(child)},
+	} {
+		if test.expected != test.actual {
+			t.Errorf("Expected %v but got %v", test.expected, test.actual)
+		}
+	}
+}
+
+func TestRunWithTimeoutCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	err := runWithTimeout(ctx, exec.Command("sleep", "30"))
+	if err != context.Canceled {
+		t.Errorf("Expected %v but got %v", context.Canceled, err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Expected canceled command to stop promptly but took %v", d)
+	}
+}
+
+func TestReapStaleOffices(t *testing.T) {
+	defer useTestProfiles(t)()
+	owned, _ := profiles.create()
+	defer profiles.release(owned)
+	stale := filepath.Join(profiles.root, "profiles", "profile-stale")
+	start := func(profile string) *exec.Cmd {
+		cmd := exec.Command("sh", "-c", "while :; do sleep 1; done", "soffice.bin", profileArg(profile))
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("Failed to start %v", err)
+		}
+		go cmd.Wait()
+		return cmd
+	}
+	staleCmd := start(stale)
+	ownedCmd := start(owned)
+	defer syscall.Kill(ownedCmd.Process.Pid, syscall.SIGKILL)
+	time.Sleep(100 * time.Millisecond)
+
+	killed := reapStaleOffices("/proc")
+	for _, test := range []struct {
+		expected interface{}
+		actual   interface{}
+	}{
+		{1, killed},
+		{true, waitGone(staleCmd.Process.Pid)},
+		{true, alive(ownedCmd.Process.Pid)},
+	} {
+		if test.expected != test.actual {
+			t.Errorf("Expected %v but got %v", test.expected, test.actual)
+		}
+	}
+}
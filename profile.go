@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+)
+
+// profileManager hands out private LibreOffice user profiles so concurrent
+// conversions neither contend for nor silently hand off to another
+// instance's profile. Profiles are copied from a template that LibreOffice
+// initialised once, which saves each conversion from creating one.
+type profileManager struct {
+	root   string
+	mu     sync.RWMutex
+	warm   bool
+	active map[string]bool
+}
+
+var profiles = &profileManager{
+	root: envString("OFFICE_WORK_ROOT", filepath.Join(os.TempDir(), "convserver")),
+}
+
+func (m *profileManager) templateDir() string {
+	return filepath.Join(m.root, "template")
+}
+
+// prepare initialises the template profile. Without it profiles start empty
+// and LibreOffice populates each on first use.
+func (m *profileManager) prepare() error {
+	if err := os.MkdirAll(filepath.Join(m.root, "profiles"), 0700); err != nil {
+		return err
+	}
+	dir := m.templateDir()
+	os.RemoveAll(dir)
+	cmd := exec.Command(envString("SOFFICE_PATH", "soffice"),
+		"--headless",
+		"--norestore",
+		"--terminate_after_init",
+		profileArg(dir))
+	if err := runWithTimeout(context.Background(), cmd); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	m.mu.Lock()
+	m.warm = true
+	m.mu.Unlock()
+	return nil
+}
+
+// create returns a new profile directory, a copy of the template when it
+// has been prepared.
+func (m *profileManager) create() (string, error) {
+	parent := filepath.Join(m.root, "profiles")
+	if err := os.MkdirAll(parent, 0700); err != nil {
+		return "", err
+	}
+	dir, err := ioutil.TempDir(parent, "profile")
+	if err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	warm := m.warm
+	if m.active == nil {
+		m.active = map[string]bool{}
+	}
+	m.active[dir] = true
+	m.mu.Unlock()
+	if warm {
+		if err := copyDir(m.templateDir(), dir); err != nil {
+			m.release(dir)
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// release removes a profile returned by create.
+func (m *profileManager) release(dir string) {
+	os.RemoveAll(dir)
+	m.mu.Lock()
+	delete(m.active, dir)
+	m.mu.Unlock()
+}
+
+func (m *profileManager) inUse(dir string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.active[dir]
+}
+
+func profileArg(dir string) string {
+	u := url.URL{Scheme: "file", Path: dir}
+	return "-env:UserInstallation=" + u.String()
+}
+
+func copyDir(src string, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode()|0700)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return copyFile(path, target, info.Mode())
+	})
+}
+
+func copyFile(src string, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func useTestProfiles(t *testing.T) func() {
+	orig := profiles
+	root, err := ioutil.TempDir("", "convserver")
+	if err != nil {
+		t.Fatalf("Failed to create work root %v", err)
+	}
+	profiles = &profileManager{root: root}
+	return func() {
+		os.RemoveAll(root)
+		profiles = orig
+	}
+}
+
+func TestProfileManagerCreate(t *testing.T) {
+	defer useTestProfiles(t)()
+	os.Setenv("SOFFICE_PATH", "mock-commands/soffice")
+	if err := profiles.prepare(); err != nil {
+		t.Fatalf("Expected nil but got %v", err)
+	}
+	first, err := profiles.create()
+	if err != nil {
+		t.Fatalf("Expected nil but got %v", err)
+	}
+	second, _ := profiles.create()
+	_, statErr := os.Stat(filepath.Join(first, "user", "registrymodifications.xcu"))
+	for _, test := range []struct {
+		expected interface{}
+		actual   interface{}
+	}{
+		{nil, statErr},
+		{true, first != second},
+		{"-env:UserInstallation=file:///tmp/foo%20bar", profileArg("/tmp/foo bar")},
+	} {
+		if test.expected != test.actual {
+			t.Errorf("Expected %v but got %v", test.expected, test.actual)
+		}
+	}
+}
+
+func TestRunWriterProfile(t *testing.T) {
+	defer useTestProfiles(t)()
+	os.Setenv("SOFFICE_PATH", "mock-commands/soffice")
+	profiles.prepare()
+	dir, _ := ioutil.TempDir("", "writer")
+	defer os.RemoveAll(dir)
+
+	err := runWriter(context.Background(), filepath.Join(dir, "foo.docx"), conversion{Format: outputFormats["pdf"], Family: documentFamilies["text"], Filter: "writer_pdf_Export"})
+	_, statErr := os.Stat(filepath.Join(dir, "foo.pdf"))
+	left, _ := ioutil.ReadDir(filepath.Join(profiles.root, "profiles"))
+	for _, test := range []struct {
+		expected interface{}
+		actual   interface{}
+	}{
+		{nil, err},
+		{nil, statErr},
+		{0, len(left)},
+	} {
+		if test.expected != test.actual {
+			t.Errorf("Expected %v but got %v", test.expected, test.actual)
+		}
+	}
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// s3Event is the body of an S3 event notification.
+type s3Event struct {
+	Records []s3EventRecord `json:"Records"`
+}
+
+type s3EventRecord struct {
+	EventName string `json:"eventName"`
+	S3        struct {
+		Bucket struct {
+			Name string `json:"name"`
+		} `json:"bucket"`
+		Object struct {
+			Key string `json:"key"`
+		} `json:"object"`
+	} `json:"s3"`
+}
+
+// s3EventRoute turns events for keys under Prefix into the request it
+// embeds. An empty bucket matches every bucket. Events arriving through SNS
+// carry no credentials and are converted only with Principal's permissions,
+// by routes that have one.
+type s3EventRoute struct {
+	Prefix    string     `json:"prefix"`
+	Principal *principal `json:"principal"`
+	requestPayload
+}
+
+type s3EventsResponse struct {
+	Jobs    []job              `json:"jobs"`
+	Skipped []skippedS3Records `json:"skipped"`
+	Queue   queueStatus        `json:"queue"`
+}
+
+type skippedS3Records struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+}
+
+var (
+	errNoS3EventRoute = errors.New("No route matches the key")
+	errSNSRoute       = errors.New("Route does not accept SNS notifications")
+)
+
+// s3EventRoutes are read from S3_EVENT_ROUTES_PATH at startup.
+var s3EventRoutes []s3EventRoute
+
+func loadS3EventRoutes() ([]s3EventRoute, error) {
+	path := os.Getenv("S3_EVENT_ROUTES_PATH")
+	if path == "" {
+		return nil, nil
+	}
+	var routes []s3EventRoute
+	if err := readJSONFile(path, &routes); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+// routeS3Object finds the request for key in bucket and the route it comes
+// from. The longest matching prefix wins.
+func routeS3Object(routes []s3EventRoute, bucket, key string) (requestPayload, *s3EventRoute, error) {
+	var match *s3EventRoute
+	for i, route := range routes {
+		if route.Bucket != "" && route.Bucket != bucket {
+			continue
+		}
+		if !strings.HasPrefix(key, strings.TrimPrefix(route.Prefix, "/")) {
+			continue
+		}
+		if match == nil || len(route.Prefix) > len(match.Prefix) {
+			match = &routes[i]
+		}
+	}
+	if match == nil {
+		return requestPayload{}, nil, errNoS3EventRoute
+	}
+	req := match.requestPayload
+	req.Bucket, req.Key = bucket, key
+	return req, match, nil
+}
+
+// derivedKeyPlaceholders stand in for the parts of an output key that vary
+// with the source or the conversion, and map to the patterns matching them.
+var derivedKeyPlaceholders = []struct{ token, pattern string }{
+	{"\x00dir\x00/", "(?:.*/)?"},
+	{"\x00dir\x00", ".*"},
+	{"\x00source\x00", ".*"},
+	{"\x00hash\x00", "[0-9a-f]+"},
+	{"\x00job_id\x00", "[0-9a-f]+"},
+}
+
+// derivedKeyRegexp matches every key the route stores converted files
+// under, whatever the source: the keys its request would produce with the
+// source and what the conversion adds left open.
+func (route *s3EventRoute) derivedKeyRegexp() *regexp.Regexp {
+	var patterns []string
+	// Previews of sources without an extension have none either.
+	for _, source := range []string{"\x00source\x00", "\x00source\x00.ext"} {
+		req := route.requestPayload
+		req.Key = source
+		for _, output := range req.plannedOutputs() {
+			key := output.Key
+			if req.KeyTemplate != "" {
+				values := keyTemplateValues(source, "\x00job_id\x00", output, "\x00hash\x00")
+				values["dir"], values["basename"] = "\x00dir\x00", "\x00source\x00"
+				key = renderKeyTemplate(req.KeyTemplate, values)
+			}
+			pattern := regexp.QuoteMeta(strings.TrimPrefix(key, "/"))
+			for _, p := range derivedKeyPlaceholders {
+				pattern = strings.Replace(pattern, p.token, p.pattern, -1)
+			}
+			patterns = append(patterns, pattern)
+		}
+	}
+	return regexp.MustCompile("^(?:" + strings.Join(patterns, "|") + ")$")
+}
+
+// isDerivedKey reports whether key in bucket is where one of routes stores
+// converted files, so uploading them does not trigger another conversion.
+func isDerivedKey(routes []s3EventRoute, bucket, key string) bool {
+	for i := range routes {
+		route := &routes[i]
+		dest := route.DestinationBucket
+		if dest == "" {
+			dest = route.Bucket
+		}
+		if dest != "" && dest != bucket {
+			continue
+		}
+		if route.derivedKeyRegexp().MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleS3Events queues a job for every object created in an S3 event
+// posted directly.
+func handleS3Events(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "We don't accept "+r.Method+" requests", http.StatusMethodNotAllowed)
+		return
+	}
+	var event s3Event
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p := principalFrom(r)
+	queueS3Event(w, event, func(*s3EventRoute) (*principal, error) { return p, nil })
+}
+
+// snsPrincipal is who events arriving through SNS act as on route.
+func snsPrincipal(route *s3EventRoute) (*principal, error) {
+	if route.Principal == nil {
+		return nil, errSNSRoute
+	}
+	return route.Principal, nil
+}
+
+// queueS3Event checks each record against the principal principalFor
+// gives for its route. Once the queue is full the remaining records are
+// skipped with the queue's error. It replies 503 only when nothing was
+// queued, so the sender's retry never converts a record twice.
+func queueS3Event(w http.ResponseWriter, event s3Event, principalFor func(*s3EventRoute) (*principal, error)) {
+	res := s3EventsResponse{Jobs: []job{}, Skipped: []skippedS3Records{}}
+	var queueErr error
+	for _, record := range event.Records {
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			key = record.S3.Object.Key
+		}
+		bucket := record.S3.Bucket.Name
+		skip := func(reason string) {
+			res.Skipped = append(res.Skipped, skippedS3Records{Bucket: bucket, Key: key, Reason: reason})
+		}
+		if !strings.HasPrefix(record.EventName, "ObjectCreated:") {
+			skip("Not an ObjectCreated event")
+			continue
+		}
+		if isDerivedKey(s3EventRoutes, bucket, key) {
+			skip("Converted file")
+			continue
+		}
+		req, route, err := routeS3Object(s3EventRoutes, bucket, key)
+		if err == nil {
+			err = validateRequest(&req)
+		}
+		var p *principal
+		if err == nil {
+			p, err = principalFor(route)
+		}
+		if err != nil {
+			skip(err.Error())
+			continue
+		}
+		if !p.allowsRequest(&req) {
+			skip(errForbidden.Error())
+			continue
+		}
+		if queueErr != nil {
+			skip(queueErr.Error())
+			continue
+		}
+		j, err := queueJob(req)
+		if err != nil {
+			queueErr = err
+			skip(err.Error())
+			continue
+		}
+		res.Jobs = append(res.Jobs, j)
+	}
+	if queueErr != nil && len(res.Jobs) == 0 {
+		status := workers.status()
+		w.Header().Set("X-Queue-Depth", strconv.Itoa(status.Depth))
+		w.Header().Set("Retry-After", strconv.Itoa(envInt("QUEUE_RETRY_AFTER_SECONDS", 30)))
+		writeJSON(w, http.StatusServiceUnavailable, errorResponse{Error: queueErr.Error(), Queue: status})
+		return
+	}
+	res.Queue = workers.status()
+	w.Header().Set("X-Queue-Depth", strconv.Itoa(res.Queue.Depth))
+	writeJSON(w, http.StatusAccepted, res)
+}
+
+// snsEnvelope is a message SNS delivers to HTTP subscribers.
+type snsEnvelope struct {
+	Type             string `json:"Type"`
+	MessageID        string `json:"MessageId"`
+	Token            string `json:"Token"`
+	TopicArn         string `json:"TopicArn"`
+	Subject          string `json:"Subject"`
+	Message          string `json:"Message"`
+	SubscribeURL     string `json:"SubscribeURL"`
+	Timestamp        string `json:"Timestamp"`
+	SignatureVersion string `json:"SignatureVersion"`
+	Signature        string `json:"Signature"`
+	SigningCertURL   string `json:"SigningCertURL"`
+}
+
+var (
+	errSNSSignature = errors.New("Invalid SNS message signature")
+	errSNSExpired   = errors.New("SNS message timestamp outside tolerance")
+	errSNSTopic     = errors.New("SNS topic is not allowed")
+	errSNSURL       = errors.New("SNS URL does not point at SNS")
+)
+
+// snsHostRegexp matches the hosts SNS certificates and subscription
+// confirmations are served from.
+var snsHostRegexp = regexp.MustCompile(`^sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?$`)
+
+var snsHTTPClient = &http.Client{Timeout: time.Second * 10}
+
+// snsCertificates caches signing certificates by URL.
+var snsCertificates = struct {
+	sync.Mutex
+	certs map[string]*x509.Certificate
+}{certs: map[string]*x509.Certificate{}}
+
+// handleSNS accepts S3 events wrapped by SNS. SNS cannot send credentials,
+// so messages are trusted by their signature and their topic, which must be
+// listed in SNS_TOPIC_ARNS, and events act as the principal of their route.
+func handleSNS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "We don't accept "+r.Method+" requests", http.StatusMethodNotAllowed)
+		return
+	}
+	var env snsEnvelope
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&env); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if topics := os.Getenv("SNS_TOPIC_ARNS"); topics == "" || !contains(strings.Split(topics, ","), env.TopicArn) {
+		http.Error(w, errSNSTopic.Error(), http.StatusForbidden)
+		return
+	}
+	if err := verifySNS(env); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	switch env.Type {
+	case "SubscriptionConfirmation":
+		if err := confirmSNSSubscription(env.SubscribeURL); err == errSNSURL {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case "Notification":
+		var event s3Event
+		if err := json.Unmarshal([]byte(env.Message), &event); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		queueS3Event(w, event, snsPrincipal)
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func snsURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || !snsHostRegexp.MatchString(u.Host) {
+		return nil, errSNSURL
+	}
+	return u, nil
+}
+
+func confirmSNSSubscription(subscribeURL string) error {
+	u, err := snsURL(subscribeURL)
+	if err != nil {
+		return err
+	}
+	res, err := snsHTTPClient.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("Failed to confirm SNS subscription: %v", res.Status)
+	}
+	return nil
+}
+
+// snsSigningString is what SNS signs for each message type.
+func snsSigningString(env snsEnvelope) string {
+	fields := [][2]string{{"Message", env.Message}, {"MessageId", env.MessageID}}
+	if env.Type == "Notification" {
+		if env.Subject != "" {
+			fields = append(fields, [2]string{"Subject", env.Subject})
+		}
+		fields = append(fields, [2]string{"Timestamp", env.Timestamp}, [2]string{"TopicArn", env.TopicArn})
+	} else {
+		fields = append(fields, [2]string{"SubscribeURL", env.SubscribeURL}, [2]string{"Timestamp", env.Timestamp},
+			[2]string{"Token", env.Token}, [2]string{"TopicArn", env.TopicArn})
+	}
+	fields = append(fields, [2]string{"Type", env.Type})
+	var b strings.Builder
+	for _, f := range fields {
+		b.WriteString(f[0] + "\n" + f[1] + "\n")
+	}
+	return b.String()
+}
+
+func verifySNS(env snsEnvelope) error {
+	sig, err := base64.StdEncoding.DecodeString(env.Signature)
+	if err != nil {
+		return errSNSSignature
+	}
+	cert, err := snsCertificate(env.SigningCertURL)
+	if err != nil {
+		return err
+	}
+	var hash crypto.Hash
+	var digest []byte
+	switch env.SignatureVersion {
+	case "1":
+		sum := sha1.Sum([]byte(snsSigningString(env)))
+		hash, digest = crypto.SHA1, sum[:]
+	case "2":
+		sum := sha256.Sum256([]byte(snsSigningString(env)))
+		hash, digest = crypto.SHA256, sum[:]
+	default:
+		return errSNSSignature
+	}
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok || rsa.VerifyPKCS1v15(key, hash, digest, sig) != nil {
+		return errSNSSignature
+	}
+	// The signature covers Timestamp, so checking it stops signed messages
+	// from being replayed later.
+	sent, err := time.Parse(time.RFC3339, env.Timestamp)
+	if err != nil {
+		return errSNSExpired
+	}
+	tolerance := time.Second * time.Duration(envInt("SNS_TOLERANCE_SECONDS", 3600))
+	if d := time.Since(sent); d > tolerance || d < -tolerance {
+		return errSNSExpired
+	}
+	return nil
+}
+
+func snsCertificate(certURL string) (*x509.Certificate, error) {
+	u, err := snsURL(certURL)
+	if err != nil {
+		return nil, err
+	}
+	snsCertificates.Lock()
+	defer snsCertificates.Unlock()
+	if cert, ok := snsCertificates.certs[u.String()]; ok {
+		return cert, nil
+	}
+	res, err := snsHTTPClient.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errSNSSignature
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	snsCertificates.certs[u.String()] = cert
+	return cert, nil
+}
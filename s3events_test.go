@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testS3EventRoutes = []s3EventRoute{
+	{Prefix: "uploads/", requestPayload: requestPayload{CallbackURL: "http://example.com/uploads"}},
+	{Prefix: "uploads/decks/", Principal: &principal{Buckets: []string{"my-bucket"}}, requestPayload: requestPayload{CallbackURL: "http://example.com/decks", Outputs: []string{"pdf", "png"}}},
+	{Prefix: "/", requestPayload: requestPayload{Bucket: "other-bucket", CallbackURL: "http://example.com/other"}},
+}
+
+func TestRouteS3Object(t *testing.T) {
+	for _, test := range []struct {
+		expected string
+		bucket   string
+		key      string
+	}{
+		{"http://example.com/uploads", "my-bucket", "uploads/a.docx"},
+		{"http://example.com/decks", "my-bucket", "uploads/decks/a.pptx"},
+		{"http://example.com/other", "other-bucket", "a.docx"},
+		{errNoS3EventRoute.Error(), "my-bucket", "a.docx"},
+	} {
+		req, _, err := routeS3Object(testS3EventRoutes, test.bucket, test.key)
+		actual := req.CallbackURL
+		if err != nil {
+			actual = err.Error()
+		} else if req.Bucket != test.bucket || req.Key != test.key {
+			t.Errorf("Expected %v %v but got %v %v", test.bucket, test.key, req.Bucket, req.Key)
+		}
+		if actual != test.expected {
+			t.Errorf("Expected %v but got %v", test.expected, actual)
+		}
+	}
+}
+
+func TestIsDerivedKey(t *testing.T) {
+	routes := []s3EventRoute{
+		{Prefix: "uploads/", requestPayload: requestPayload{Thumbnails: []thumbnailSpec{{Width: 320, Pages: 2}}, ExtractText: "json"}},
+		{Prefix: "decks/", requestPayload: requestPayload{Outputs: []string{"pdf", "png"}, KeyTemplate: "uploads/{dir}/converted/{basename}-{hash}.{ext}"}},
+		{Prefix: "media/", requestPayload: requestPayload{Bucket: "media", DestinationBucket: "cdn", KeyTemplate: "/{job_id}/{name}.{ext}"}},
+	}
+	for _, test := range []struct {
+		expected bool
+		bucket   string
+		key      string
+	}{
+		{false, "my-bucket", "uploads/a.pptx"},
+		{false, "my-bucket", "uploads/preview.pdf"},
+		{false, "my-bucket", "uploads/report-text.docx"},
+		{true, "my-bucket", convertPreiviewKey("uploads/a.pptx")},
+		{true, "my-bucket", convertPreiviewKey("uploads/a")},
+		{true, "my-bucket", convertThumbnailKey("uploads/a.pptx", thumbnailSpec{Width: 320, Pages: 2}, 2)},
+		{false, "my-bucket", convertThumbnailKey("uploads/a.pptx", thumbnailSpec{Width: 320, Pages: 2}, 3)},
+		{true, "my-bucket", convertTextKey("uploads/a.pptx", textFormats["json"])},
+		{true, "my-bucket", "uploads/decks/converted/a-0f1e2d.png"},
+		{true, "my-bucket", "uploads/converted/a-0f1e2d.pdf"},
+		{false, "my-bucket", "uploads/decks/converted/a-0f1e2d.docx"},
+		{true, "cdn", "5c2a3e1d8f7b4a6e9d0c1b2a3f4e5d6c/preview.pdf"},
+		{false, "media", "5c2a3e1d8f7b4a6e9d0c1b2a3f4e5d6c/preview.pdf"},
+	} {
+		if actual := isDerivedKey(routes, test.bucket, test.key); actual != test.expected {
+			t.Errorf("Expected %v but got %v for %v/%v", test.expected, actual, test.bucket, test.key)
+		}
+	}
+}
+
+// useBlockedWorkers queues tasks without ever running them.
+func useBlockedWorkers() func() {
+	orig := workers
+	workers = newWorkerPool(1, 10)
+	started := make(chan bool)
+	workers.submit(func() {
+		started <- true
+		select {}
+	})
+	<-started
+	return func() { workers = orig }
+}
+
+const testS3Event = `{"Records":[
+	{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"my-bucket"},"object":{"key":"uploads/decks/awesome+deck.pptx"}}},
+	{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"my-bucket"},"object":{"key":"uploads/decks/awesome+deck-preview.pdf"}}},
+	{"eventName":"ObjectRemoved:Delete","s3":{"bucket":{"name":"my-bucket"},"object":{"key":"uploads/a.docx"}}},
+	{"eventName":"ObjectCreated:Copy","s3":{"bucket":{"name":"my-bucket"},"object":{"key":"elsewhere/a.docx"}}}
+]}`
+
+func TestHandleS3Events(t *testing.T) {
+	defer useBlockedWorkers()()
+	orig := s3EventRoutes
+	s3EventRoutes = testS3EventRoutes
+	defer func() { s3EventRoutes = orig }()
+
+	w := httptest.NewRecorder()
+	handleS3Events(w, httptest.NewRequest("POST", "/s3-events", strings.NewReader(testS3Event)))
+	var res s3EventsResponse
+	json.NewDecoder(w.Body).Decode(&res)
+	if w.Code != http.StatusAccepted || len(res.Jobs) != 1 || len(res.Skipped) != 3 {
+		t.Fatalf("Expected 1 job and 3 skipped records but got %v %v", w.Code, res)
+	}
+	for _, test := range []struct {
+		expected interface{}
+		actual   interface{}
+	}{
+		{"uploads/decks/awesome deck.pptx", res.Jobs[0].Request.Key},
+		{"http://example.com/decks", res.Jobs[0].Request.CallbackURL},
+		{"Converted file", res.Skipped[0].Reason},
+		{"Not an ObjectCreated event", res.Skipped[1].Reason},
+		{errNoS3EventRoute.Error(), res.Skipped[2].Reason},
+		{1, res.Queue.Depth},
+	} {
+		if test.expected != test.actual {
+			t.Errorf("Expected %v but got %v", test.expected, test.actual)
+		}
+	}
+}
+
+func TestHandleS3EventsQueueFull(t *testing.T) {
+	orig, origRoutes := workers, s3EventRoutes
+	defer func() { workers, s3EventRoutes = orig, origRoutes }()
+	s3EventRoutes = testS3EventRoutes
+	workers = newWorkerPool(1, 1)
+	started := make(chan bool)
+	workers.submit(func() {
+		started <- true
+		select {}
+	})
+	<-started
+
+	event := `{"Records":[
+		{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"my-bucket"},"object":{"key":"uploads/decks/a.pptx"}}},
+		{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"my-bucket"},"object":{"key":"uploads/decks/b.pptx"}}}
+	]}`
+	w := httptest.NewRecorder()
+	handleS3Events(w, httptest.NewRequest("POST", "/s3-events", strings.NewReader(event)))
+	var res s3EventsResponse
+	json.NewDecoder(w.Body).Decode(&res)
+	if w.Code != http.StatusAccepted || len(res.Jobs) != 1 || len(res.Skipped) != 1 {
+		t.Fatalf("Expected 1 job and 1 skipped record but got %v %v", w.Code, res)
+	}
+	if res.Skipped[0].Key != "uploads/decks/b.pptx" || res.Skipped[0].Reason != errQueueFull.Error() {
+		t.Errorf("Expected %v but got %v", errQueueFull, res.Skipped[0])
+	}
+
+	w = httptest.NewRecorder()
+	handleS3Events(w, httptest.NewRequest("POST", "/s3-events", strings.NewReader(event)))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected %v but got %v", http.StatusServiceUnavailable, w.Code)
+	}
+}
+
+// useTestSNS serves a signing certificate and subscription confirmations
+// from a local TLS server standing in for SNS.
+func useTestSNS(t *testing.T) (*rsa.PrivateKey, *httptest.Server, *int) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.amazonaws.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	confirmed := 0
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/cert.pem":
+			pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+		case "/confirm":
+			confirmed++
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return key, server, &confirmed
+}
+
+func signSNS(t *testing.T, key *rsa.PrivateKey, env *snsEnvelope) {
+	env.SignatureVersion = "2"
+	sum := sha256.Sum256([]byte(snsSigningString(*env)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Signature = base64.StdEncoding.EncodeToString(sig)
+}
+
+func TestHandleSNS(t *testing.T) {
+	defer useBlockedWorkers()()
+	key, server, confirmed := useTestSNS(t)
+	defer server.Close()
+	origHost, origClient, origRoutes := snsHostRegexp, snsHTTPClient, s3EventRoutes
+	snsHostRegexp = regexp.MustCompile("^" + regexp.QuoteMeta(strings.TrimPrefix(server.URL, "https://")) + "$")
+	snsHTTPClient = server.Client()
+	s3EventRoutes = testS3EventRoutes
+	defer func() { snsHostRegexp, snsHTTPClient, s3EventRoutes = origHost, origClient, origRoutes }()
+	topic := "arn:aws:sns:us-east-1:123456789012:uploads"
+	os.Setenv("SNS_TOPIC_ARNS", "arn:aws:sns:us-east-1:123456789012:other,"+topic)
+	defer os.Unsetenv("SNS_TOPIC_ARNS")
+
+	post := func(env snsEnvelope) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(env)
+		w := httptest.NewRecorder()
+		handleSNS(w, httptest.NewRequest("POST", "/s3-events/sns", strings.NewReader(string(b))))
+		return w
+	}
+	confirmation := snsEnvelope{
+		Type:           "SubscriptionConfirmation",
+		MessageID:      "m1",
+		Token:          "token",
+		TopicArn:       topic,
+		Message:        "You have chosen to subscribe",
+		SubscribeURL:   server.URL + "/confirm",
+		Timestamp:      time.Now().UTC().Format(time.RFC3339Nano),
+		SigningCertURL: server.URL + "/cert.pem",
+	}
+	signSNS(t, key, &confirmation)
+	notification := snsEnvelope{
+		Type:           "Notification",
+		MessageID:      "m2",
+		TopicArn:       topic,
+		Subject:        "Amazon S3 Notification",
+		Message:        testS3Event,
+		Timestamp:      time.Now().UTC().Format(time.RFC3339Nano),
+		SigningCertURL: server.URL + "/cert.pem",
+	}
+	signSNS(t, key, &notification)
+	forged := notification
+	forged.Message = strings.Replace(testS3Event, "uploads/decks/awesome", "uploads/decks/forged", 1)
+	redirected := confirmation
+	redirected.SubscribeURL = "https://169.254.169.254/latest/meta-data"
+	signSNS(t, key, &redirected)
+	otherTopic := notification
+	otherTopic.TopicArn = "arn:aws:sns:us-east-1:210987654321:uploads"
+	signSNS(t, key, &otherTopic)
+	noPrincipal := notification
+	noPrincipal.Message = `{"Records":[{"eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"my-bucket"},"object":{"key":"uploads/a.docx"}}}]}`
+	signSNS(t, key, &noPrincipal)
+	stale := notification
+	stale.Timestamp = time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339Nano)
+	signSNS(t, key, &stale)
+
+	for _, test := range []struct {
+		expected int
+		env      snsEnvelope
+	}{
+		{http.StatusOK, confirmation},
+		{http.StatusAccepted, notification},
+		{http.StatusForbidden, forged},
+		{http.StatusForbidden, redirected},
+		{http.StatusForbidden, otherTopic},
+		{http.StatusAccepted, noPrincipal},
+		{http.StatusForbidden, stale},
+	} {
+		if actual := post(test.env).Code; actual != test.expected {
+			t.Errorf("Expected %v but got %v for %v", test.expected, actual, test.env.Type)
+		}
+	}
+	if *confirmed != 1 {
+		t.Errorf("Expected 1 but got %v", *confirmed)
+	}
+	if depth := workers.status().Depth; depth != 1 {
+		t.Errorf("Expected 1 but got %v", depth)
+	}
+
+	var res s3EventsResponse
+	json.NewDecoder(post(noPrincipal).Body).Decode(&res)
+	if len(res.Skipped) != 1 || res.Skipped[0].Reason != errSNSRoute.Error() {
+		t.Errorf("Expected %v but got %v", errSNSRoute, res.Skipped)
+	}
+	os.Unsetenv("SNS_TOPIC_ARNS")
+	if actual := post(notification).Code; actual != http.StatusForbidden {
+		t.Errorf("Expected %v without SNS_TOPIC_ARNS but got %v", http.StatusForbidden, actual)
+	}
+}
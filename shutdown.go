@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var errJobAborted = errors.New("Conversion aborted by server shutdown")
+
+// jobContext is what queued jobs run under. It is cancelled when shutdown
+// gives up waiting for them, which stops LibreOffice and fails the jobs,
+// except for those the job store will resume that had not started yet.
+var jobContext, abortJobs = context.WithCancel(context.Background())
+
+// aborted reports whether jobs are being aborted.
+func aborted() bool {
+	return jobContext.Err() != nil
+}
+
+// serve runs server until SIGTERM or SIGINT, then shuts down gracefully.
+// stop is closed to tell other sources of jobs to stop taking them.
+func serve(server *http.Server, stop chan struct{}) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		log.Printf("Received %v, shutting down", sig)
+	}
+	shutdown(server, stop,
+		time.Second*time.Duration(envInt("SHUTDOWN_GRACE_SECONDS", 30)),
+		time.Second*time.Duration(envInt("SHUTDOWN_ABORT_SECONDS", 10)))
+	return nil
+}
+
+// shutdown stops accepting requests and lets queued and running jobs finish
+// within grace. Jobs still unfinished then are aborted and given
+// abortGrace to send their failure callbacks.
+func shutdown(server *http.Server, stop chan struct{}, grace time.Duration, abortGrace time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	close(stop)
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Failed to close connections: %v", err)
+	}
+	workers.close()
+	if err := workers.wait(ctx); err != nil {
+		status := workers.status()
+		log.Printf("Aborting %v running and %v queued jobs", status.Busy, status.Depth)
+		abortJobs()
+		abortCtx, cancel := context.WithTimeout(context.Background(), abortGrace)
+		defer cancel()
+		if err := workers.wait(abortCtx); err != nil {
+			log.Printf("Gave up waiting for aborted jobs: %v", err)
+		}
+	}
+	if offices != nil {
+		offices.close()
+	}
+}
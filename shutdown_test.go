@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gock "gopkg.in/h2non/gock.v1"
+)
+
+func useTestJobContext() func() {
+	origCtx, origAbort := jobContext, abortJobs
+	jobContext, abortJobs = context.WithCancel(context.Background())
+	return func() {
+		abortJobs()
+		jobContext, abortJobs = origCtx, origAbort
+	}
+}
+
+func useTestWorkers(size int, queueSize int) func() {
+	orig := workers
+	workers = newWorkerPool(size, queueSize)
+	return func() { workers = orig }
+}
+
+func TestShutdownDrains(t *testing.T) {
+	defer useTestJobContext()()
+	defer useTestWorkers(1, 10)()
+	ran := make(chan int, 2)
+	workers.submit(func() {
+		time.Sleep(time.Millisecond * 20)
+		ran <- 1
+	})
+	workers.submit(func() { ran <- 2 })
+	stop := make(chan struct{})
+
+	shutdown(&http.Server{}, stop, time.Second, time.Second)
+	close(ran)
+	var order []int
+	for i := range ran {
+		order = append(order, i)
+	}
+	_, stopped := <-stop
+	for _, test := range []struct {
+		expected interface{}
+		actual   interface{}
+	}{
+		{2, len(order)},
+		{false, aborted()},
+		{false, stopped},
+		{errShuttingDown, workers.submit(func() {})},
+	} {
+		if test.expected != test.actual {
+			t.Errorf("Expected %v but got %v", test.expected, test.actual)
+		}
+	}
+}
+
+func TestShutdownAborts(t *testing.T) {
+	defer useTestJobContext()()
+	defer useTestWorkers(1, 10)()
+	ctx := jobContext
+	finished := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		workers.submit(func() {
+			select {
+			case <-ctx.Done():
+				finished <- ctx.Err()
+			case <-time.After(time.Second * 5):
+				finished <- nil
+			}
+		})
+	}
+
+	start := time.Now()
+	shutdown(&http.Server{}, make(chan struct{}), time.Millisecond*20, time.Second)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected shutdown to abort the jobs but it took %v", elapsed)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-finished; err != context.Canceled {
+			t.Errorf("Expected %v but got %v", context.Canceled, err)
+		}
+	}
+}
+
+func TestRunCommandAborted(t *testing.T) {
+	defer useTestJobContext()()
+	defer useTestDeliverer(t)()
+	abortJobs()
+
+	defer gock.Off()
+	gock.New("http://internal-foo-test-api.bar.baz").
+		Post("/path/to/callback").
+		MatchType("json").
+		BodyString(`"status":"failed".*"code":"aborted"`).
+		Reply(200)
+
+	req := requestPayload{
+		Bucket:      "test-bucket",
+		Key:         "/path/to/awesome.pptx",
+		CallbackURL: "http://internal-foo-test-api.bar.baz/path/to/callback",
+	}
+	j := jobs.create(req)
+	err := runCommand(j.ID, req)
+	cerr, ok := err.(*conversionError)
+	actual, _ := jobs.get(j.ID)
+	for _, test := range []struct {
+		expected interface{}
+		actual   interface{}
+	}{
+		{true, ok},
+		{codeAborted, cerr.Code},
+		{jobFailed, actual.State},
+		{true, gock.IsDone()},
+	} {
+		if test.expected != test.actual {
+			t.Errorf("Expected %v but got %v", test.expected, test.actual)
+		}
+	}
+}
+
+func TestRunCommandAbortedResumable(t *testing.T) {
+	defer useTestJobContext()()
+	defer useTestDeliverer(t)()
+	abortJobs()
+	dir, _ := ioutil.TempDir("", "jobstore")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jobs.jsonl")
+	orig := jobs
+	defer func() { jobs = orig }()
+	jobs = newJobRegistry(10)
+	jobs.open(path)
+
+	defer gock.Off()
+	gock.New("http://internal-foo-test-api.bar.baz").
+		Post("/path/to/callback").
+		Reply(200)
+
+	req := requestPayload{
+		Bucket:      "test-bucket",
+		Key:         "/path/to/awesome.pptx",
+		CallbackURL: "http://internal-foo-test-api.bar.baz/path/to/callback",
+	}
+	j, _ := jobs.accept(req)
+	err := runCommand(j.ID, req)
+	actual, _ := jobs.get(j.ID)
+	unfinished, _ := newJobRegistry(10).open(path)
+	for _, test := range []struct {
+		expected interface{}
+		actual   interface{}
+	}{
+		{errJobAborted, err},
+		{jobQueued, actual.State},
+		{false, gock.IsDone()},
+		{1, len(unfinished)},
+	} {
+		if test.expected != test.actual {
+			t.Errorf("Expected %v but got %v", test.expected, test.actual)
+		}
+	}
+}
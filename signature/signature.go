@@ -0,0 +1,132 @@
+// Package signature signs and verifies the callbacks sent by convserver.
+//
+// Each callback carries the Unix time it was sent in TimestampHeader and one
+// or more HMAC-SHA256 signatures of "<timestamp>.<body>" in SignatureHeader,
+// formatted as "v1=<hex>" and separated by commas. The server signs with every
+// active secret so receivers can rotate secrets without dropping callbacks.
+//
+// Requests signed for convserver's API sign RequestMessage instead of the bare
+// body, so a signature is only valid for the method and request URI it was
+// made for.
+package signature
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SignatureHeader = "X-Convserver-Signature"
+	TimestampHeader = "X-Convserver-Timestamp"
+	scheme          = "v1"
+)
+
+var (
+	ErrMissingHeader = errors.New("signature: missing signature or timestamp")
+	ErrInvalidTime   = errors.New("signature: invalid timestamp")
+	ErrExpired       = errors.New("signature: timestamp outside tolerance")
+	ErrMismatch      = errors.New("signature: no matching signature")
+)
+
+// Sign returns the hex encoded signature of body sent at timestamp.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Header returns the SignatureHeader value signing body with every secret.
+func Header(secrets [][]byte, timestamp string, body []byte) string {
+	values := make([]string, len(secrets))
+	for i, secret := range secrets {
+		values[i] = scheme + "=" + Sign(secret, timestamp, body)
+	}
+	return strings.Join(values, ",")
+}
+
+// Verify checks that header holds a signature of body made with one of
+// secrets and that timestamp is within tolerance of now. A zero tolerance
+// skips the timestamp check.
+func Verify(secrets [][]byte, header string, timestamp string, body []byte, tolerance time.Duration) error {
+	if header == "" || timestamp == "" {
+		return ErrMissingHeader
+	}
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidTime
+	}
+	if tolerance > 0 {
+		d := time.Since(time.Unix(sec, 0))
+		if d > tolerance || d < -tolerance {
+			return ErrExpired
+		}
+	}
+	for _, value := range strings.Split(header, ",") {
+		parts := strings.SplitN(strings.TrimSpace(value), "=", 2)
+		if len(parts) != 2 || parts[0] != scheme {
+			continue
+		}
+		actual, err := hex.DecodeString(parts[1])
+		if err != nil {
+			continue
+		}
+		for _, secret := range secrets {
+			expected, _ := hex.DecodeString(Sign(secret, timestamp, body))
+			if hmac.Equal(actual, expected) {
+				return nil
+			}
+		}
+	}
+	return ErrMismatch
+}
+
+// RequestMessage returns what is signed in place of body for an API request:
+// "<method>.<requestURI>.<body>", where requestURI is the path and query.
+func RequestMessage(method string, requestURI string, body []byte) []byte {
+	return append([]byte(method+"."+requestURI+"."), body...)
+}
+
+// VerifyRequest verifies the signature headers of r against its body. The
+// body is returned and left readable on r.
+func VerifyRequest(r *http.Request, secrets [][]byte, tolerance time.Duration) ([]byte, error) {
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+	return body, Verify(secrets, r.Header.Get(SignatureHeader), r.Header.Get(TimestampHeader), body, tolerance)
+}
+
+// VerifyAPIRequest is VerifyRequest for API requests, whose signatures cover
+// RequestMessage of r's method, request URI and body.
+func VerifyAPIRequest(r *http.Request, secrets [][]byte, tolerance time.Duration) ([]byte, error) {
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+	uri := r.RequestURI
+	if uri == "" {
+		uri = r.URL.RequestURI()
+	}
+	message := RequestMessage(r.Method, uri, body)
+	return body, Verify(secrets, r.Header.Get(SignatureHeader), r.Header.Get(TimestampHeader), message, tolerance)
+}
+
+func readBody(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
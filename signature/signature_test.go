@@ -0,0 +1,86 @@
+package signature
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	actual := Sign([]byte("secret"), "1477021948", []byte(`{"status":"completed"}`))
+	expected := "a7ca714045a41d66cedc0318c6615f2bc4dc17e95ab943424a7fcf60a9ba6ffa"
+	if actual != expected {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"status":"completed"}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	header := Header([][]byte{[]byte("new"), []byte("old")}, now, body)
+	for _, test := range []struct {
+		expected  error
+		secrets   [][]byte
+		header    string
+		timestamp string
+		body      []byte
+	}{
+		{nil, [][]byte{[]byte("old")}, header, now, body},
+		{nil, [][]byte{[]byte("other"), []byte("new")}, header, now, body},
+		{ErrMismatch, [][]byte{[]byte("other")}, header, now, body},
+		{ErrMismatch, [][]byte{[]byte("new")}, header, now, []byte(`{"status":"failed"}`)},
+		{ErrExpired, [][]byte{[]byte("new")}, Header([][]byte{[]byte("new")}, old, body), old, body},
+		{ErrInvalidTime, [][]byte{[]byte("new")}, header, "yesterday", body},
+		{ErrMissingHeader, [][]byte{[]byte("new")}, "", now, body},
+	} {
+		actual := Verify(test.secrets, test.header, test.timestamp, test.body, 5*time.Minute)
+		if actual != test.expected {
+			t.Errorf("Expected %v but got %v", test.expected, actual)
+		}
+	}
+}
+
+func TestVerifyRequest(t *testing.T) {
+	body := []byte(`{"status":"completed"}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	r := httptest.NewRequest("POST", "/callback", bytes.NewReader(body))
+	r.Header.Set(TimestampHeader, now)
+	r.Header.Set(SignatureHeader, Header([][]byte{[]byte("secret")}, now, body))
+	actual, err := VerifyRequest(r, [][]byte{[]byte("secret")}, time.Minute)
+	if err != nil {
+		t.Errorf("Expected nil but got %v", err)
+	}
+	if string(actual) != string(body) {
+		t.Errorf("Expected %v but got %v", string(body), string(actual))
+	}
+}
+
+func TestVerifyAPIRequest(t *testing.T) {
+	body := []byte(`{"bucket":"my-bucket","key":"foo.pptx"}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	header := Header([][]byte{[]byte("secret")}, now, RequestMessage("POST", "/?wait=true", body))
+	for _, test := range []struct {
+		expected error
+		method   string
+		target   string
+	}{
+		{nil, "POST", "/?wait=true"},
+		{ErrMismatch, "POST", "/"},
+		{ErrMismatch, "POST", "/admin/dead-letters/replay?wait=true"},
+		{ErrMismatch, "PUT", "/?wait=true"},
+	} {
+		r := httptest.NewRequest(test.method, test.target, bytes.NewReader(body))
+		r.Header.Set(TimestampHeader, now)
+		r.Header.Set(SignatureHeader, header)
+		actual, err := VerifyAPIRequest(r, [][]byte{[]byte("secret")}, time.Minute)
+		if err != test.expected {
+			t.Errorf("Expected %v but got %v", test.expected, err)
+		}
+		if string(actual) != string(body) {
+			t.Errorf("Expected %v but got %v", string(body), string(actual))
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/private/protocol/query"
+	bugsnag "github.com/bugsnag/bugsnag-go"
+)
+
+// sqsClient speaks the three SQS actions the consumer needs over the SDK's
+// query protocol. The vendored SDK does not ship the SQS service.
+type sqsClient struct {
+	*client.Client
+}
+
+type sqsMessage struct {
+	_             struct{} `type:"structure"`
+	MessageId     *string  `type:"string"`
+	ReceiptHandle *string  `type:"string"`
+	Body          *string  `type:"string"`
+}
+
+type sqsReceiveMessageInput struct {
+	_                   struct{} `type:"structure"`
+	QueueUrl            *string  `type:"string" required:"true"`
+	MaxNumberOfMessages *int64   `type:"integer"`
+	VisibilityTimeout   *int64   `type:"integer"`
+	WaitTimeSeconds     *int64   `type:"integer"`
+}
+
+type sqsReceiveMessageOutput struct {
+	_        struct{}      `type:"structure"`
+	Messages []*sqsMessage `locationNameList:"Message" type:"list" flattened:"true"`
+}
+
+type sqsChangeMessageVisibilityInput struct {
+	_                 struct{} `type:"structure"`
+	QueueUrl          *string  `type:"string" required:"true"`
+	ReceiptHandle     *string  `type:"string" required:"true"`
+	VisibilityTimeout *int64   `type:"integer" required:"true"`
+}
+
+type sqsDeleteMessageInput struct {
+	_             struct{} `type:"structure"`
+	QueueUrl      *string  `type:"string" required:"true"`
+	ReceiptHandle *string  `type:"string" required:"true"`
+}
+
+type sqsEmptyOutput struct {
+	_ struct{} `type:"structure"`
+}
+
+// newSQSClient talks to SQS_ENDPOINT when it is set, which points the
+// consumer at a local stand-in.
+func newSQSClient(p client.ConfigProvider, cfgs ...*aws.Config) *sqsClient {
+	if endpoint := os.Getenv("SQS_ENDPOINT"); endpoint != "" {
+		cfgs = append(cfgs, &aws.Config{Endpoint: aws.String(endpoint)})
+	}
+	c := p.ClientConfig("sqs", cfgs...)
+	svc := &sqsClient{
+		Client: client.New(
+			*c.Config,
+			metadata.ClientInfo{
+				ServiceName:   "sqs",
+				SigningRegion: c.SigningRegion,
+				Endpoint:      c.Endpoint,
+				APIVersion:    "2012-11-05",
+			},
+			c.Handlers,
+		),
+	}
+	svc.Handlers.Sign.PushBackNamed(v4.SignRequestHandler)
+	svc.Handlers.Build.PushBackNamed(query.BuildHandler)
+	svc.Handlers.Unmarshal.PushBackNamed(query.UnmarshalHandler)
+	svc.Handlers.UnmarshalMeta.PushBackNamed(query.UnmarshalMetaHandler)
+	svc.Handlers.UnmarshalError.PushBackNamed(query.UnmarshalErrorHandler)
+	return svc
+}
+
+func (c *sqsClient) send(name string, input, output interface{}) error {
+	op := &request.Operation{Name: name, HTTPMethod: "POST", HTTPPath: "/"}
+	return c.NewRequest(op, input, output).Send()
+}
+
+func (c *sqsClient) receiveMessage(input *sqsReceiveMessageInput) (*sqsReceiveMessageOutput, error) {
+	output := &sqsReceiveMessageOutput{}
+	return output, c.send("ReceiveMessage", input, output)
+}
+
+func (c *sqsClient) changeMessageVisibility(input *sqsChangeMessageVisibilityInput) error {
+	return c.send("ChangeMessageVisibility", input, &sqsEmptyOutput{})
+}
+
+func (c *sqsClient) deleteMessage(input *sqsDeleteMessageInput) error {
+	return c.send("DeleteMessage", input, &sqsEmptyOutput{})
+}
+
+// sqsConsumer feeds requests from a queue to the workers. A message stays
+// invisible while its conversion runs and is deleted once the completion
+// callback has been delivered; anything else leaves it for redelivery, so
+// the queue's redrive policy decides when to give up.
+type sqsConsumer struct {
+	client     *sqsClient
+	queueURL   string
+	wait       int64
+	visibility int64
+	// retryInterval is how long to back off after a failed receive.
+	retryInterval time.Duration
+	// run is called to process each request, runCommand outside tests.
+	run func(id string, req requestPayload) error
+}
+
+func newSQSConsumer(queueURL string) *sqsConsumer {
+	return &sqsConsumer{
+		client:        newSQSClient(session.New()),
+		queueURL:      queueURL,
+		wait:          int64(envInt("SQS_WAIT_SECONDS", 20)),
+		visibility:    int64(envInt("SQS_VISIBILITY_TIMEOUT_SECONDS", 120)),
+		retryInterval: time.Second * time.Duration(envInt("SQS_RETRY_INTERVAL_SECONDS", 5)),
+		run:           runCommand,
+	}
+}
+
+// consume long-polls the queue until stop is closed. It only asks for as
+// many messages as the workers have room for.
+func (c *sqsConsumer) consume(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		status := workers.status()
+		room := status.Capacity - status.Depth
+		if room > 10 {
+			room = 10
+		}
+		if room < 1 {
+			time.Sleep(time.Second)
+			continue
+		}
+		out, err := c.client.receiveMessage(&sqsReceiveMessageInput{
+			QueueUrl:            &c.queueURL,
+			MaxNumberOfMessages: aws.Int64(int64(room)),
+			VisibilityTimeout:   &c.visibility,
+			WaitTimeSeconds:     &c.wait,
+		})
+		if err != nil {
+			log.Printf("Failed to receive messages from %v: %v", c.queueURL, err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(c.retryInterval):
+			}
+			continue
+		}
+		for _, msg := range out.Messages {
+			c.handle(msg)
+		}
+	}
+}
+
+// handle queues the request in msg. Messages that are not valid requests are
+// deleted straight away, since no redelivery could make them succeed.
+func (c *sqsConsumer) handle(msg *sqsMessage) {
+	var req requestPayload
+	err := json.Unmarshal([]byte(aws.StringValue(msg.Body)), &req)
+	if err == nil {
+		err = validateRequest(&req)
+	}
+	if err != nil {
+		log.Printf("Discarding invalid message %v: %v", aws.StringValue(msg.MessageId), err)
+		bugsnag.Notify(err, bugsnag.MetaData{"message": {"MessageId": aws.StringValue(msg.MessageId)}})
+		c.delete(msg)
+		return
+	}
+	j := jobs.create(req)
+	stopHeartbeat := c.heartbeat(msg)
+	err = workers.submit(func() {
+		err := c.run(j.ID, req)
+		stopHeartbeat()
+		if err == nil {
+			c.delete(msg)
+		}
+	})
+	if err != nil {
+		// Hand the message back at once so another instance can take it.
+		stopHeartbeat()
+		jobs.remove(j.ID)
+		c.changeVisibility(msg, 0)
+	}
+}
+
+// heartbeat keeps msg invisible until the returned function is called,
+// covering time spent queued as well as converting.
+func (c *sqsConsumer) heartbeat(msg *sqsMessage) func() {
+	done := make(chan struct{})
+	interval := time.Second * time.Duration(c.visibility) / 2
+	if interval <= 0 {
+		interval = time.Second
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				c.changeVisibility(msg, c.visibility)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+func (c *sqsConsumer) changeVisibility(msg *sqsMessage, seconds int64) {
+	err := c.client.changeMessageVisibility(&sqsChangeMessageVisibilityInput{
+		QueueUrl:          &c.queueURL,
+		ReceiptHandle:     msg.ReceiptHandle,
+		VisibilityTimeout: &seconds,
+	})
+	if err != nil {
+		log.Printf("Failed to change visibility of message %v: %v", aws.StringValue(msg.MessageId), err)
+	}
+}
+
+func (c *sqsConsumer) delete(msg *sqsMessage) {
+	err := c.client.deleteMessage(&sqsDeleteMessageInput{
+		QueueUrl:      &c.queueURL,
+		ReceiptHandle: msg.ReceiptHandle,
+	})
+	if err != nil {
+		log.Printf("Failed to delete message %v: %v", aws.StringValue(msg.MessageId), err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// fakeSQS answers the query API with the given message bodies once, then
+// with empty receives, and records what was deleted or handed back.
+type fakeSQS struct {
+	mu       sync.Mutex
+	bodies   []string
+	deleted  []string
+	released []string
+}
+
+func (q *fakeSQS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	switch r.Form.Get("Action") {
+	case "ReceiveMessage":
+		if len(q.bodies) == 0 {
+			time.Sleep(time.Millisecond * 10)
+		}
+		fmt.Fprint(w, "<ReceiveMessageResponse><ReceiveMessageResult>")
+		for i, body := range q.bodies {
+			fmt.Fprintf(w, "<Message><MessageId>m%d</MessageId><ReceiptHandle>r%d</ReceiptHandle><Body><![CDATA[%s]]></Body></Message>", i, i, body)
+		}
+		fmt.Fprint(w, "</ReceiveMessageResult></ReceiveMessageResponse>")
+		q.bodies = nil
+	case "DeleteMessage":
+		q.deleted = append(q.deleted, r.Form.Get("ReceiptHandle"))
+		fmt.Fprint(w, "<DeleteMessageResponse></DeleteMessageResponse>")
+	case "ChangeMessageVisibility":
+		if r.Form.Get("VisibilityTimeout") == "0" {
+			q.released = append(q.released, r.Form.Get("ReceiptHandle"))
+		}
+		fmt.Fprint(w, "<ChangeMessageVisibilityResponse></ChangeMessageVisibilityResponse>")
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, "<ErrorResponse><Error><Code>InvalidAction</Code></Error></ErrorResponse>")
+	}
+}
+
+func (q *fakeSQS) deletedHandles() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	handles := append([]string{}, q.deleted...)
+	sort.Strings(handles)
+	return handles
+}
+
+func testSQSClient(server *httptest.Server) *sqsClient {
+	return newSQSClient(session.New(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Endpoint:    aws.String(server.URL),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+		HTTPClient:  server.Client(),
+	}))
+}
+
+func TestSQSConsumer(t *testing.T) {
+	queue := &fakeSQS{bodies: []string{
+		`{"bucket":"my-bucket","key":"/ok.docx","callback_url":"http://example.com/callback"}`,
+		`{"bucket":"my-bucket","key":"/broken.docx","callback_url":"http://example.com/callback"}`,
+		`{"bucket":"my-bucket","key":"/ok.docx","outputs":["gif"]}`,
+		`not json`,
+	}}
+	server := httptest.NewServer(queue)
+	defer server.Close()
+
+	ran := make(chan string, 4)
+	c := &sqsConsumer{
+		client:        testSQSClient(server),
+		queueURL:      server.URL + "/queue/conversions",
+		visibility:    60,
+		retryInterval: time.Millisecond,
+		run: func(id string, req requestPayload) error {
+			defer func() { ran <- req.Key }()
+			if req.Key == "/broken.docx" {
+				return errors.New("conversion failed")
+			}
+			return nil
+		},
+	}
+	stop := make(chan struct{})
+	go c.consume(stop)
+	defer close(stop)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-ran:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("Expected both valid messages to be run")
+		}
+	}
+	expected := []string{"r0", "r2", "r3"}
+	deadline := time.Now().Add(time.Second * 5)
+	for len(queue.deletedHandles()) < len(expected) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if actual := queue.deletedHandles(); fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+}
+
+func TestSQSConsumerQueueFull(t *testing.T) {
+	orig := workers
+	workers = newWorkerPool(1, 0)
+	defer func() { workers = orig }()
+	block := make(chan struct{})
+	defer close(block)
+	// The pool has no queue, so wait for its worker to take the task.
+	for workers.submit(func() { <-block }) != nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	queue := &fakeSQS{}
+	server := httptest.NewServer(queue)
+	defer server.Close()
+	c := &sqsConsumer{
+		client:     testSQSClient(server),
+		queueURL:   server.URL + "/queue/conversions",
+		visibility: 60,
+		run:        func(id string, req requestPayload) error { return nil },
+	}
+	body := `{"bucket":"my-bucket","key":"/ok.docx","callback_url":"http://example.com/callback"}`
+	c.handle(&sqsMessage{MessageId: aws.String("m0"), ReceiptHandle: aws.String("r0"), Body: &body})
+	if expected := "[r0]"; fmt.Sprint(queue.released) != expected {
+		t.Errorf("Expected %v but got %v", expected, queue.released)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// Storage holds source documents and the files converted from them. Keys
+// are slash separated paths within the storage.
+type Storage interface {
+	Get(key string) (io.ReadCloser, error)
+	Put(key string, body io.Reader, contentType string) error
+	Head(key string) (storageObject, error)
+	Delete(key string) error
+}
+
+type storageObject struct {
+	Size        int64
+	ContentType string
+	Modified    time.Time
+}
+
+var (
+	errObjectNotFound    = errors.New("Object not found")
+	errFileStorageOff    = errors.New("file:// sources are disabled, set STORAGE_FILE_ROOT to enable them")
+	errHTTPStorageOff    = errors.New("http(s):// sources are disabled, set STORAGE_HTTP_HOSTS to enable them")
+	errSourceAndLocation = errors.New("Give either source or bucket and key, not both")
+	errKeyDotDot         = errors.New("key may not contain .. segments")
+)
+
+// storageLocation is where a request's source lives. Bucket is the S3
+// bucket or HTTP host, and empty for the local filesystem. Query is the
+// query string of an HTTP source, such as a pre-signed URL's signature.
+type storageLocation struct {
+	Scheme string
+	Bucket string
+	Key    string
+	Query  string
+}
+
+func parseStorageURI(uri string) (storageLocation, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return storageLocation{}, fmt.Errorf("Invalid source %q", uri)
+	}
+	switch u.Scheme {
+	case "s3":
+		key := strings.TrimPrefix(u.Path, "/")
+		if u.Host == "" || key == "" {
+			return storageLocation{}, fmt.Errorf("Invalid source %q, expected s3://bucket/key", uri)
+		}
+		return storageLocation{Scheme: "s3", Bucket: u.Host, Key: key}, nil
+	case "file":
+		if u.Host != "" || u.Path == "" {
+			return storageLocation{}, fmt.Errorf("Invalid source %q, expected file:///path", uri)
+		}
+		return storageLocation{Scheme: "file", Key: u.Path}, nil
+	case "http", "https":
+		if u.Host == "" || u.Path == "" {
+			return storageLocation{}, fmt.Errorf("Invalid source %q", uri)
+		}
+		return storageLocation{Scheme: u.Scheme, Bucket: u.Host, Key: u.Path, Query: u.RawQuery}, nil
+	}
+	return storageLocation{}, fmt.Errorf("Unsupported source scheme %q, expected s3, file, http or https", u.Scheme)
+}
+
+// validateSource resolves the source URI into the request's bucket and key,
+// which the rest of the pipeline derives output keys from. Keys with ..
+// segments are rejected, since backends resolving them would read and
+// write outside the prefixes callers are checked against.
+func validateSource(req *requestPayload) error {
+	if req.Source != "" {
+		if req.Bucket != "" || req.Key != "" {
+			return errSourceAndLocation
+		}
+		loc, err := parseStorageURI(req.Source)
+		if err != nil {
+			return err
+		}
+		if _, err := newStorage(loc); err != nil {
+			return err
+		}
+		req.Bucket, req.Key = loc.Bucket, loc.Key
+	}
+	for _, segment := range strings.Split(req.Key, "/") {
+		if segment == ".." {
+			return errKeyDotDot
+		}
+	}
+	return nil
+}
+
+// storage opens the backend holding the request's source. Requests naming
+// only a bucket and key use S3.
+func (req *requestPayload) storage() (Storage, error) {
+	if req.Source == "" {
+		return newStorage(storageLocation{Scheme: "s3", Bucket: req.Bucket, Key: req.Key})
+	}
+	loc, err := parseStorageURI(req.Source)
+	if err != nil {
+		return nil, err
+	}
+	return newStorage(loc)
+}
+
+func newStorage(loc storageLocation) (Storage, error) {
+	switch loc.Scheme {
+	case "s3":
+		return &s3Storage{bucket: loc.Bucket, client: s3.New(session.New())}, nil
+	case "file":
+		root := os.Getenv("STORAGE_FILE_ROOT")
+		if root == "" {
+			return nil, errFileStorageOff
+		}
+		return &fileStorage{root: root}, nil
+	case "http", "https":
+		hosts := strings.Split(os.Getenv("STORAGE_HTTP_HOSTS"), ",")
+		if !contains(hosts, loc.Bucket) && !contains(hosts, "*") {
+			return nil, errHTTPStorageOff
+		}
+		return &httpStorage{scheme: loc.Scheme, host: loc.Bucket, sourceKey: loc.Key, sourceQuery: loc.Query, client: storageHTTPClient}, nil
+	}
+	return nil, fmt.Errorf("Unsupported storage %q", loc.Scheme)
+}
+
+type s3Storage struct {
+	bucket string
+	client *s3.S3
+}
+
+func (s *s3Storage) Get(key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(&s3.GetObjectInput{Bucket: &s.bucket, Key: &key})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return out.Body, nil
+}
+
+func (s *s3Storage) Put(key string, body io.Reader, contentType string) error {
+	_, err := s3manager.NewUploaderWithClient(s.client).Upload(&s3manager.UploadInput{
+		Bucket:      &s.bucket,
+		Key:         &key,
+		Body:        body,
+		ContentType: &contentType,
+	})
+	return err
+}
+
+func (s *s3Storage) Head(key string) (storageObject, error) {
+	out, err := s.client.HeadObject(&s3.HeadObjectInput{Bucket: &s.bucket, Key: &key})
+	if err != nil {
+		return storageObject{}, s3Error(err)
+	}
+	obj := storageObject{}
+	if out.ContentLength != nil {
+		obj.Size = *out.ContentLength
+	}
+	if out.ContentType != nil {
+		obj.ContentType = *out.ContentType
+	}
+	if out.LastModified != nil {
+		obj.Modified = *out.LastModified
+	}
+	return obj, nil
+}
+
+func (s *s3Storage) Delete(key string) error {
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{Bucket: &s.bucket, Key: &key})
+	return err
+}
+
+func s3Error(err error) error {
+	if aerr, ok := err.(awserr.Error); ok && (aerr.Code() == "NoSuchKey" || aerr.Code() == "NotFound") {
+		return errObjectNotFound
+	}
+	return err
+}
+
+// fileStorage keeps objects under root. Keys cannot escape it.
+type fileStorage struct {
+	root string
+}
+
+func (s *fileStorage) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+func (s *fileStorage) Get(key string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, errObjectNotFound
+	}
+	return f, err
+}
+
+// Put writes through a temporary file so readers never see partial objects.
+func (s *fileStorage) Put(key string, body io.Reader, contentType string) error {
+	dest := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(dest), ".upload")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), dest)
+}
+
+func (s *fileStorage) Head(key string) (storageObject, error) {
+	fi, err := os.Stat(s.path(key))
+	if os.IsNotExist(err) {
+		return storageObject{}, errObjectNotFound
+	}
+	if err != nil {
+		return storageObject{}, err
+	}
+	return storageObject{
+		Size:        fi.Size(),
+		ContentType: mime.TypeByExtension(filepath.Ext(key)),
+		Modified:    fi.ModTime(),
+	}, nil
+}
+
+func (s *fileStorage) Delete(key string) error {
+	err := os.Remove(s.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// httpStorage reads with GET and writes with PUT to URLs on one host. The
+// source's query string is only sent for the source, so a pre-signed URL
+// can be read while outputs are written to plain URLs.
+type httpStorage struct {
+	scheme      string
+	host        string
+	sourceKey   string
+	sourceQuery string
+	client      *http.Client
+}
+
+var storageHTTPClient = &http.Client{
+	Timeout: time.Second * time.Duration(envInt("STORAGE_HTTP_TIMEOUT_SECONDS", 300)),
+}
+
+func (s *httpStorage) url(key string) string {
+	u := &url.URL{Scheme: s.scheme, Host: s.host, Path: key}
+	if key == s.sourceKey {
+		u.RawQuery = s.sourceQuery
+	}
+	return u.String()
+}
+
+func (s *httpStorage) do(method, key string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.url(key), body)
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := body.(*os.File); ok {
+		if fi, err := f.Stat(); err == nil {
+			req.ContentLength = fi.Size()
+		}
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, errObjectNotFound
+	}
+	if res.StatusCode/100 != 2 {
+		res.Body.Close()
+		return nil, fmt.Errorf("%v %v: %v", method, s.url(key), res.Status)
+	}
+	return res, nil
+}
+
+func (s *httpStorage) Get(key string) (io.ReadCloser, error) {
+	res, err := s.do("GET", key, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+func (s *httpStorage) Put(key string, body io.Reader, contentType string) error {
+	res, err := s.do("PUT", key, body, contentType)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (s *httpStorage) Head(key string) (storageObject, error) {
+	res, err := s.do("HEAD", key, nil, "")
+	if err != nil {
+		return storageObject{}, err
+	}
+	res.Body.Close()
+	obj := storageObject{Size: res.ContentLength, ContentType: res.Header.Get("Content-Type")}
+	obj.Modified, _ = http.ParseTime(res.Header.Get("Last-Modified"))
+	return obj, nil
+}
+
+func (s *httpStorage) Delete(key string) error {
+	res, err := s.do("DELETE", key, nil, "")
+	if err == errObjectNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// download copies the object at key into f.
+func download(store Storage, key string, f *os.File) error {
+	body, err := store.Get(key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	_, err = io.Copy(f, body)
+	return err
+}
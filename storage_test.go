@@ -0,0 +1,200 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gock "gopkg.in/h2non/gock.v1"
+)
+
+func TestParseStorageURI(t *testing.T) {
+	for _, test := range []struct {
+		expected storageLocation
+		err      string
+		uri      string
+	}{
+		{storageLocation{"s3", "my-bucket", "path/to/awesome.pptx", ""}, "", "s3://my-bucket/path/to/awesome.pptx"},
+		{storageLocation{"file", "", "/docs/awesome.pptx", ""}, "", "file:///docs/awesome.pptx"},
+		{storageLocation{"https", "files.example.com", "/docs/awesome deck.pptx", ""}, "", "https://files.example.com/docs/awesome%20deck.pptx"},
+		{storageLocation{"https", "files.example.com", "/docs/a.pptx", "X-Amz-Expires=300&X-Amz-Signature=abc"}, "", "https://files.example.com/docs/a.pptx?X-Amz-Expires=300&X-Amz-Signature=abc"},
+		{storageLocation{}, `Invalid source "s3://my-bucket", expected s3://bucket/key`, "s3://my-bucket"},
+		{storageLocation{}, `Invalid source "file://host/docs/a.docx", expected file:///path`, "file://host/docs/a.docx"},
+		{storageLocation{}, `Unsupported source scheme "ftp", expected s3, file, http or https`, "ftp://example.com/a.docx"},
+	} {
+		actual, err := parseStorageURI(test.uri)
+		msg := ""
+		if err != nil {
+			msg = err.Error()
+		}
+		if actual != test.expected || msg != test.err {
+			t.Errorf("Expected %v %v but got %v %v", test.expected, test.err, actual, msg)
+		}
+	}
+}
+
+func TestValidateSource(t *testing.T) {
+	os.Setenv("STORAGE_HTTP_HOSTS", "files.example.com")
+	defer os.Unsetenv("STORAGE_HTTP_HOSTS")
+	for _, test := range []struct {
+		expected string
+		req      requestPayload
+		bucket   string
+		key      string
+	}{
+		{"", requestPayload{Bucket: "my-bucket", Key: "/a.docx"}, "my-bucket", "/a.docx"},
+		{"", requestPayload{Source: "https://files.example.com/a.docx"}, "files.example.com", "/a.docx"},
+		{errSourceAndLocation.Error(), requestPayload{Source: "s3://my-bucket/a.docx", Key: "a.docx"}, "", "a.docx"},
+		{errHTTPStorageOff.Error(), requestPayload{Source: "http://169.254.169.254/latest/meta-data"}, "", ""},
+		{errFileStorageOff.Error(), requestPayload{Source: "file:///etc/passwd"}, "", ""},
+		{errKeyDotDot.Error(), requestPayload{Bucket: "my-bucket", Key: "allowed/../secret/x.docx"}, "my-bucket", "allowed/../secret/x.docx"},
+		{errKeyDotDot.Error(), requestPayload{Source: "https://files.example.com/allowed/%2e%2e/secret/x.docx"}, "files.example.com", "/allowed/../secret/x.docx"},
+	} {
+		actual := ""
+		if err := validateSource(&test.req); err != nil {
+			actual = err.Error()
+		}
+		if actual != test.expected || test.req.Bucket != test.bucket || test.req.Key != test.key {
+			t.Errorf("Expected %v %v %v but got %v %v %v", test.expected, test.bucket, test.key, actual, test.req.Bucket, test.req.Key)
+		}
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	root, _ := ioutil.TempDir("", "storage")
+	defer os.RemoveAll(root)
+	s := &fileStorage{root: root}
+	if err := s.Put("/docs/a.txt", strings.NewReader("hello"), "text/plain"); err != nil {
+		t.Fatalf("Expected nil but got %v", err)
+	}
+	if err := s.Put("../../outside.txt", strings.NewReader("escaped"), "text/plain"); err != nil {
+		t.Fatalf("Expected nil but got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "outside.txt")); err != nil {
+		t.Errorf("Expected the key to stay under the root but got %v", err)
+	}
+	body, err := s.Get("docs/a.txt")
+	if err != nil {
+		t.Fatalf("Expected nil but got %v", err)
+	}
+	b, _ := ioutil.ReadAll(body)
+	body.Close()
+	obj, err := s.Head("/docs/a.txt")
+	for _, test := range []struct {
+		expected interface{}
+		actual   interface{}
+	}{
+		{"hello", string(b)},
+		{nil, err},
+		{int64(5), obj.Size},
+		{"text/plain; charset=utf-8", obj.ContentType},
+		{nil, s.Delete("/docs/a.txt")},
+		{nil, s.Delete("/docs/a.txt")},
+	} {
+		if test.expected != test.actual {
+			t.Errorf("Expected %v but got %v", test.expected, test.actual)
+		}
+	}
+	if _, err := s.Get("/docs/a.txt"); err != errObjectNotFound {
+		t.Errorf("Expected %v but got %v", errObjectNotFound, err)
+	}
+}
+
+func TestHTTPStorage(t *testing.T) {
+	objects := map[string]string{"/docs/a.txt": "hello"}
+	queries := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := objects[r.URL.Path]
+		queries[r.Method+" "+r.URL.Path] = r.URL.RawQuery
+		switch r.Method {
+		case "PUT":
+			b, _ := ioutil.ReadAll(r.Body)
+			objects[r.URL.Path] = r.Header.Get("Content-Type") + ":" + string(b)
+			w.WriteHeader(http.StatusCreated)
+			return
+		case "DELETE":
+			delete(objects, r.URL.Path)
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+	s := &httpStorage{scheme: "http", host: strings.TrimPrefix(server.URL, "http://"), sourceKey: "/docs/a.txt", sourceQuery: "X-Amz-Signature=abc", client: server.Client()}
+
+	body, err := s.Get("/docs/a.txt")
+	if err != nil {
+		t.Fatalf("Expected nil but got %v", err)
+	}
+	b, _ := ioutil.ReadAll(body)
+	body.Close()
+	obj, err := s.Head("/docs/a.txt")
+	for _, test := range []struct {
+		expected interface{}
+		actual   interface{}
+	}{
+		{"hello", string(b)},
+		{nil, err},
+		{int64(5), obj.Size},
+		{nil, s.Put("/docs/a.pdf", strings.NewReader("%PDF"), "application/pdf")},
+		{"application/pdf:%PDF", objects["/docs/a.pdf"]},
+		{"X-Amz-Signature=abc", queries["GET /docs/a.txt"]},
+		{"", queries["PUT /docs/a.pdf"]},
+		{nil, s.Delete("/docs/a.txt")},
+		{nil, s.Delete("/docs/a.txt")},
+	} {
+		if test.expected != test.actual {
+			t.Errorf("Expected %v but got %v", test.expected, test.actual)
+		}
+	}
+	if _, err := s.Get("/docs/a.txt"); err != errObjectNotFound {
+		t.Errorf("Expected %v but got %v", errObjectNotFound, err)
+	}
+}
+
+func TestRunCommandFileStorage(t *testing.T) {
+	defer useTestProfiles(t)()
+	defer useTestDeliverer(t)()
+	os.Setenv("SOFFICE_PATH", "mock-commands/soffice")
+	os.Setenv("PDF_INFO_PATH", "mock-commands/pdfinfo")
+	profiles.prepare()
+	root, _ := ioutil.TempDir("", "storage")
+	defer os.RemoveAll(root)
+	os.Setenv("STORAGE_FILE_ROOT", root)
+	defer os.Unsetenv("STORAGE_FILE_ROOT")
+	os.MkdirAll(filepath.Join(root, "docs"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "docs", "deck.pptx"), []byte("pptx"), 0644)
+
+	defer gock.Off()
+	gock.New("http://internal-foo-test-api.bar.baz").
+		Put("/path/to/callback").
+		MatchType("json").
+		BodyString(`"status":"completed".*"key":"/docs/deck-preview.pdf"`).
+		Reply(200)
+
+	req := requestPayload{
+		Source:             "file:///docs/deck.pptx",
+		CallbackURL:        "http://internal-foo-test-api.bar.baz/path/to/callback",
+		CallbackHTTPMethod: "PUT",
+	}
+	if err := validateRequest(&req); err != nil {
+		t.Fatalf("Expected nil but got %v", err)
+	}
+	j := jobs.create(req)
+	if err := runCommand(j.ID, req); err != nil {
+		t.Errorf("Expected nil but got %v", err)
+	}
+	b, _ := ioutil.ReadFile(filepath.Join(root, "docs", "deck-preview.pdf"))
+	if expected := "converted with pdf:impress_pdf_Export\n"; string(b) != expected {
+		t.Errorf("Expected %v but got %v", expected, string(b))
+	}
+	if !gock.IsDone() {
+		t.Errorf("Expected the callback to be sent")
+	}
+}
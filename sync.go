@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// syncDocumentName is used when the client does not name its upload.
+const syncDocumentName = "document"
+
+// handleSyncConvert converts the document in the request body, either raw
+// or as the "file" part of a multipart form, and streams the result back.
+// The conversion runs on the shared workers, so it counts against the same
+// limits as queued jobs.
+func handleSyncConvert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "We don't accept "+r.Method+" requests", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, int64(envInt("SYNC_MAX_BODY_BYTES", 50<<20)))
+	body, name, params, err := syncUpload(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer body.Close()
+
+	format := params.Get("format")
+	if format == "" {
+		format = "pdf"
+	}
+	req := requestPayload{
+		Key:          name,
+		Outputs:      []string{format},
+		DocumentType: params.Get("document_type"),
+	}
+	if err := validateOutputs(req.Outputs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateFamily(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "sync")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cleanup := true
+	defer func() {
+		if cleanup {
+			os.RemoveAll(dir)
+		}
+	}()
+	// The output may have the upload's name, so they live apart.
+	for _, sub := range []string{"in", "out"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0700); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	filename := filepath.Join(dir, "in", name)
+	if err := saveUpload(filename, body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*time.Duration(envInt("SYNC_TIMEOUT_SECONDS", 30)))
+	defer cancel()
+	c := req.conversion(outputFormats[format])
+	c.OutDir = filepath.Join(dir, "out")
+	done := make(chan error, 1)
+	err = workers.submit(func() {
+		if err := ctx.Err(); err != nil {
+			done <- err
+			return
+		}
+		done <- runWriter(ctx, filename, c)
+	})
+	status := workers.status()
+	w.Header().Set("X-Queue-Depth", strconv.Itoa(status.Depth))
+	if err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(envInt("QUEUE_RETRY_AFTER_SECONDS", 30)))
+		writeJSON(w, http.StatusServiceUnavailable, errorResponse{Error: err.Error(), Queue: status})
+		return
+	}
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		// Leave the files to the conversion, which may still be queued.
+		cleanup = false
+		go func() {
+			<-done
+			os.RemoveAll(dir)
+		}()
+		err = ctx.Err()
+	}
+	switch {
+	case err == context.DeadlineExceeded || isTimeout(err):
+		http.Error(w, "Conversion timed out", http.StatusGatewayTimeout)
+		return
+	case err != nil:
+		http.Error(w, "Conversion failed: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	out, err := os.Open(c.output(filename))
+	if err != nil {
+		http.Error(w, "Conversion failed: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	defer out.Close()
+	payload, err := filePayloadFromFile(out, c.Format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeFileHeaders(w.Header(), payload)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": filepath.Base(outputPath(name, c.Format)),
+	}))
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, out)
+}
+
+// syncUpload finds the document, its name and the conversion parameters in
+// r. Raw bodies are named by the filename query parameter and take their
+// parameters from the query alone, as parsing a form would consume them.
+func syncUpload(r *http.Request) (io.ReadCloser, string, url.Values, error) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(int64(envInt("SYNC_MEMORY_BYTES", 10<<20))); err != nil {
+			return nil, "", nil, err
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			return nil, "", nil, errors.New("Missing file part in the multipart form")
+		}
+		return file, safeDocumentName(header.Filename), r.Form, nil
+	}
+	query := r.URL.Query()
+	return r.Body, safeDocumentName(query.Get("filename")), query, nil
+}
+
+// safeDocumentName keeps only the last element of a client supplied name so
+// it cannot escape the conversion's directory.
+func safeDocumentName(name string) string {
+	name = filepath.Base(strings.Replace(name, "\\", "/", -1))
+	if name == "." || name == "/" || strings.HasPrefix(name, ".") {
+		return syncDocumentName
+	}
+	return name
+}
+
+func saveUpload(filename string, body io.Reader) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, body)
+	return err
+}
+
+// writeFileHeaders describes the converted file in response headers.
+func writeFileHeaders(h http.Header, payload fileResponsePayload) {
+	h.Set("Content-Type", payload.ContentType)
+	h.Set("Content-Length", strconv.Itoa(payload.ContentSize))
+	h.Set("X-Content-Hash", payload.ContentHash)
+	if payload.Width > 0 {
+		h.Set("X-Width", strconv.Itoa(payload.Width))
+		h.Set("X-Height", strconv.Itoa(payload.Height))
+	}
+	if payload.PageCount > 0 {
+		h.Set("X-Page-Count", strconv.Itoa(payload.PageCount))
+	}
+	if payload.PDFVersion != "" {
+		h.Set("X-PDF-Version", payload.PDFVersion)
+	}
+}
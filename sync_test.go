@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHandleSyncConvert(t *testing.T) {
+	defer useTestProfiles(t)()
+	os.Setenv("SOFFICE_PATH", "mock-commands/soffice")
+	os.Setenv("PDF_INFO_PATH", "mock-commands/pdfinfo")
+	profiles.prepare()
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	mw.WriteField("format", "docx")
+	fw, _ := mw.CreateFormFile("file", "../../letter.rtf")
+	fw.Write([]byte("{\\rtf1 Dear sata}"))
+	mw.Close()
+	multipartReq := httptest.NewRequest("POST", "/convert", &form)
+	multipartReq.Header.Set("Content-Type", mw.FormDataContentType())
+	// curl --data-binary sends raw bodies as a form by default.
+	formEncodedReq := httptest.NewRequest("POST", "/convert?filename=notes.txt&format=txt", strings.NewReader("notes"))
+	formEncodedReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	for _, test := range []struct {
+		req     *http.Request
+		body    string
+		headers map[string]string
+	}{
+		{
+			httptest.NewRequest("POST", "/convert?filename=deck.pptx", strings.NewReader("pptx")),
+			"converted with pdf:impress_pdf_Export\n",
+			map[string]string{
+				"Content-Type":        "application/pdf",
+				"Content-Length":      "38",
+				"Content-Disposition": `attachment; filename=deck.pdf`,
+				"X-Width":             "842",
+				"X-Height":            "595",
+				"X-Page-Count":        "15",
+				"X-PDF-Version":       "1.4",
+			},
+		},
+		{
+			multipartReq,
+			"converted with docx:MS Word 2007 XML\n",
+			map[string]string{
+				"Content-Type":        "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+				"Content-Disposition": `attachment; filename=letter.docx`,
+				"X-Page-Count":        "",
+			},
+		},
+		{
+			formEncodedReq,
+			"converted with txt:Text\n",
+			map[string]string{
+				"Content-Disposition": `attachment; filename=notes.txt`,
+			},
+		},
+	} {
+		w := httptest.NewRecorder()
+		handleSyncConvert(w, test.req)
+		if w.Code != http.StatusOK || w.Body.String() != test.body {
+			t.Errorf("Expected %v %v but got %v %v", http.StatusOK, test.body, w.Code, w.Body.String())
+		}
+		for k, v := range test.headers {
+			if actual := w.Header().Get(k); actual != v {
+				t.Errorf("Expected %v: %v but got %v", k, v, actual)
+			}
+		}
+	}
+}
+
+func TestHandleSyncConvertErrors(t *testing.T) {
+	defer useTestProfiles(t)()
+	os.Setenv("SOFFICE_PATH", "mock-commands/soffice")
+	// No template profile, so the mock fails to convert.
+	for _, test := range []struct {
+		expected int
+		req      *http.Request
+	}{
+		{http.StatusMethodNotAllowed, httptest.NewRequest("GET", "/convert", nil)},
+		{http.StatusBadRequest, httptest.NewRequest("POST", "/convert?format=mp4", strings.NewReader("doc"))},
+		{http.StatusBadRequest, httptest.NewRequest("POST", "/convert?filename=deck.pptx&format=xlsx", strings.NewReader("doc"))},
+		{http.StatusUnprocessableEntity, httptest.NewRequest("POST", "/convert?filename=letter.docx", strings.NewReader("doc"))},
+	} {
+		w := httptest.NewRecorder()
+		handleSyncConvert(w, test.req)
+		if w.Code != test.expected {
+			t.Errorf("Expected %v but got %v", test.expected, w.Code)
+		}
+	}
+}
+
+func TestSafeDocumentName(t *testing.T) {
+	for _, test := range []struct {
+		expected string
+		name     string
+	}{
+		{"deck.pptx", "deck.pptx"},
+		{"deck.pptx", "../../deck.pptx"},
+		{"deck.pptx", "C:\\Users\\sata\\deck.pptx"},
+		{"document", ""},
+		{"document", ".."},
+		{"document", ".bashrc"},
+	} {
+		if actual := safeDocumentName(test.name); actual != test.expected {
+			t.Errorf("Expected %v but got %v", test.expected, actual)
+		}
+	}
+}
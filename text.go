@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// textFormats are the shapes extracted text is stored in.
+var textFormats = map[string]outputFormat{
+	"txt":  {Name: "txt", Extension: "txt", ContentType: "text/plain; charset=utf-8"},
+	"json": {Name: "json", Extension: "json", ContentType: "application/json"},
+}
+
+type textPage struct {
+	Page int    `json:"page"`
+	Text string `json:"text"`
+}
+
+type textDocument struct {
+	Pages []textPage `json:"pages"`
+}
+
+func validateExtractText(req *requestPayload) error {
+	if req.ExtractText == "" {
+		return nil
+	}
+	if _, ok := textFormats[req.ExtractText]; !ok {
+		return fmt.Errorf("Unknown extract_text %q, expected txt or json", req.ExtractText)
+	}
+	if _, ok := req.family().Filters["txt"]; !contains(req.outputs(), "pdf") && !ok {
+		return fmt.Errorf("Text is extracted from the pdf output for a %v document, which was not requested", req.family().Name)
+	}
+	return nil
+}
+
+// convertTextKey derives where extracted text is stored from the source key.
+func convertTextKey(orgKey string, format outputFormat) string {
+	return strings.TrimSuffix(orgKey, filepath.Ext(orgKey)) + "-text." + format.Extension
+}
+
+// extractText reads the text of filename, converted to PDF or plain text
+// beforehand, page by page. LibreOffice's text export has no pages, so it
+// comes back as one.
+func extractText(ctx context.Context, filename string, fromPDF bool) ([]string, error) {
+	var b []byte
+	var err error
+	if fromPDF {
+		b, err = pdfText(ctx, outputPath(filename, outputFormats["pdf"]))
+	} else {
+		b, err = ioutil.ReadFile(outputPath(filename, outputFormats["txt"]))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !utf8.Valid(b) {
+		return nil, errors.New("Extracted text is not valid UTF-8")
+	}
+	// pdftotext ends every page, including the last, with a form feed.
+	pages := strings.Split(strings.TrimSuffix(string(b), "\f"), "\f")
+	return pages, nil
+}
+
+func pdfText(ctx context.Context, pdf string) ([]byte, error) {
+	out, err := ioutil.TempFile("", "text")
+	if err != nil {
+		return nil, err
+	}
+	out.Close()
+	defer os.Remove(out.Name())
+	cmd := exec.Command(envString("PDFTOTEXT_PATH", "pdftotext"), "-enc", "UTF-8", pdf, out.Name())
+	if err := runWithTimeout(ctx, cmd); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(out.Name())
+}
+
+// writeText stores pages at path, separated by form feeds or as JSON.
+func writeText(pages []string, path string, format outputFormat) error {
+	if format.Name == "txt" {
+		return ioutil.WriteFile(path, []byte(strings.Join(pages, "\f")), 0644)
+	}
+	doc := textDocument{Pages: make([]textPage, len(pages))}
+	for i, text := range pages {
+		doc.Pages[i] = textPage{Page: i + 1, Text: text}
+	}
+	b, err := json.Marshal(&doc)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
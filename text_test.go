@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestValidateExtractText(t *testing.T) {
+	for _, test := range []struct {
+		expected string
+		req      requestPayload
+	}{
+		{"", requestPayload{Key: "foo.pptx", ExtractText: "json"}},
+		{"", requestPayload{Key: "foo.docx", ExtractText: "txt", Outputs: []string{"docx"}}},
+		{`Unknown extract_text "xml", expected txt or json`, requestPayload{Key: "foo.docx", ExtractText: "xml"}},
+		{"Text is extracted from the pdf output for a presentation document, which was not requested", requestPayload{Key: "foo.pptx", ExtractText: "txt", Outputs: []string{"png"}}},
+	} {
+		actual := ""
+		if err := validateExtractText(&test.req); err != nil {
+			actual = err.Error()
+		}
+		if actual != test.expected {
+			t.Errorf("Expected %v but got %v", test.expected, actual)
+		}
+	}
+}
+
+func TestConvertTextKey(t *testing.T) {
+	expected := "/foo/bar/baz-text.json"
+	if actual := convertTextKey("/foo/bar/baz.pptx", textFormats["json"]); actual != expected {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+}
+
+func TestExtractText(t *testing.T) {
+	os.Setenv("PDFTOTEXT_PATH", "mock-commands/pdftotext")
+	defer os.Unsetenv("PDFTOTEXT_PATH")
+	dir, _ := ioutil.TempDir("", "text")
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "foo.docx")
+
+	pages, err := extractText(context.Background(), filename, true)
+	if expected := []string{"page 1", "page 2", "page 3"}; err != nil || !reflect.DeepEqual(expected, pages) {
+		t.Errorf("Expected %v but got %v %v", expected, pages, err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "foo.txt"), []byte("Dear sata,\n"), 0644)
+	pages, err = extractText(context.Background(), filename, false)
+	if expected := []string{"Dear sata,\n"}; err != nil || !reflect.DeepEqual(expected, pages) {
+		t.Errorf("Expected %v but got %v %v", expected, pages, err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "foo.txt"), []byte{0xff, 0xfe}, 0644)
+	expected := "Extracted text is not valid UTF-8"
+	if _, err = extractText(context.Background(), filename, false); err == nil || err.Error() != expected {
+		t.Errorf("Expected %v but got %v", expected, err)
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "text")
+	defer os.RemoveAll(dir)
+	for _, test := range []struct {
+		expected string
+		format   string
+	}{
+		{"page 1\fpage 2", "txt"},
+		{`{"pages":[{"page":1,"text":"page 1"},{"page":2,"text":"page 2"}]}`, "json"},
+	} {
+		path := filepath.Join(dir, "text."+test.format)
+		if err := writeText([]string{"page 1", "page 2"}, path, textFormats[test.format]); err != nil {
+			t.Errorf("Expected nil but got %v", err)
+		}
+		b, _ := ioutil.ReadFile(path)
+		if string(b) != test.expected {
+			t.Errorf("Expected %v but got %v", test.expected, string(b))
+		}
+	}
+}
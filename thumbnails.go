@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// thumbnailSpec asks for the first Pages pages of the preview PDF rendered
+// Width pixels wide.
+type thumbnailSpec struct {
+	Width  int    `json:"width"`
+	Format string `json:"format,omitempty"`
+	Pages  int    `json:"pages,omitempty"`
+}
+
+var imageFormats = map[string]outputFormat{
+	"png":  {Name: "png", Extension: "png", ContentType: "image/png"},
+	"jpeg": {Name: "jpeg", Extension: "jpg", ContentType: "image/jpeg"},
+	"webp": {Name: "webp", Extension: "webp", ContentType: "image/webp"},
+}
+
+var renderedPageRegexp = regexp.MustCompile("-(\\d+)\\.(png|jpg)$")
+
+func (s thumbnailSpec) format() outputFormat {
+	if s.Format == "" {
+		return imageFormats["png"]
+	}
+	return imageFormats[s.Format]
+}
+
+func (s thumbnailSpec) pages() int {
+	if s.Pages < 1 {
+		return 1
+	}
+	return s.Pages
+}
+
+func validateThumbnails(specs []thumbnailSpec, outputs []string) error {
+	if len(specs) == 0 {
+		return nil
+	}
+	if !contains(outputs, "pdf") {
+		return errors.New("Thumbnails are rendered from the pdf output, which was not requested")
+	}
+	maxWidth := envInt("THUMBNAIL_MAX_WIDTH", 4096)
+	maxPages := envInt("THUMBNAIL_MAX_PAGES", 50)
+	seen := map[string]bool{}
+	for _, s := range specs {
+		if _, ok := imageFormats[s.Format]; s.Format != "" && !ok {
+			return fmt.Errorf("Unknown thumbnail format %q, expected png, jpeg or webp", s.Format)
+		}
+		if s.Width < 1 || s.Width > maxWidth {
+			return fmt.Errorf("Thumbnail width must be between 1 and %v", maxWidth)
+		}
+		if s.Pages > maxPages {
+			return fmt.Errorf("Thumbnails may cover at most %v pages", maxPages)
+		}
+		id := strconv.Itoa(s.Width) + s.format().Extension
+		if seen[id] {
+			return fmt.Errorf("Thumbnail %vpx %v requested twice", s.Width, s.format().Name)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// thumbnailName is the entry a thumbnail is reported under in the callback.
+func thumbnailName(spec thumbnailSpec, page int) string {
+	return fmt.Sprintf("p%d-%dw.%s", page, spec.Width, spec.format().Extension)
+}
+
+// convertThumbnailKey derives a thumbnail's key from the preview's key.
+func convertThumbnailKey(orgKey string, spec thumbnailSpec, page int) string {
+	preview := convertPreiviewKey(orgKey)
+	return strings.TrimSuffix(preview, filepath.Ext(preview)) + "-" + thumbnailName(spec, page)
+}
+
+type renderedPage struct {
+	Page int
+	Path string
+}
+
+// renderThumbnails rasterizes the leading pages of pdf into dir. Pages
+// beyond the end of the document are skipped.
+func renderThumbnails(ctx context.Context, pdf string, dir string, spec thumbnailSpec) ([]renderedPage, error) {
+	prefix := filepath.Join(dir, fmt.Sprintf("%dw-%s", spec.Width, spec.format().Name))
+	args := []string{
+		"-f", "1",
+		"-l", strconv.Itoa(spec.pages()),
+		"-scale-to-x", strconv.Itoa(spec.Width),
+		"-scale-to-y", "-1",
+	}
+	if spec.format().Name == "jpeg" {
+		args = append(args, "-jpeg", "-jpegopt", "quality="+strconv.Itoa(envInt("THUMBNAIL_QUALITY", 85)))
+	} else {
+		args = append(args, "-png")
+	}
+	cmd := exec.Command(envString("PDFTOPPM_PATH", "pdftoppm"), append(args, pdf, prefix)...)
+	if err := runWithTimeout(ctx, cmd); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(prefix + "-*")
+	if err != nil {
+		return nil, err
+	}
+	var pages []renderedPage
+	for _, f := range files {
+		m := renderedPageRegexp.FindStringSubmatch(f)
+		if m == nil {
+			continue
+		}
+		page, _ := strconv.Atoi(m[1])
+		pages = append(pages, renderedPage{Page: page, Path: f})
+	}
+	if len(pages) == 0 {
+		return nil, errors.New("pdftoppm rendered no pages")
+	}
+	sort.Sort(byPage(pages))
+	if spec.format().Name != "webp" {
+		return pages, nil
+	}
+	for i, p := range pages {
+		webp := strings.TrimSuffix(p.Path, filepath.Ext(p.Path)) + ".webp"
+		cmd := exec.Command(envString("CWEBP_PATH", "cwebp"),
+			"-quiet",
+			"-q", strconv.Itoa(envInt("THUMBNAIL_QUALITY", 85)),
+			p.Path,
+			"-o", webp)
+		err := runWithTimeout(ctx, cmd)
+		os.Remove(p.Path)
+		if err != nil {
+			return nil, err
+		}
+		pages[i].Path = webp
+	}
+	return pages, nil
+}
+
+type byPage []renderedPage
+
+func (p byPage) Len() int           { return len(p) }
+func (p byPage) Less(i, j int) bool { return p[i].Page < p[j].Page }
+func (p byPage) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// webpSize reads the canvas size from a WebP file header.
+func webpSize(filename string) (int, int, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(b) < 30 || string(b[0:4]) != "RIFF" || string(b[8:12]) != "WEBP" {
+		return 0, 0, errors.New("Invalid WebP file")
+	}
+	switch string(b[12:16]) {
+	case "VP8 ":
+		w := int(binary.LittleEndian.Uint16(b[26:28]) & 0x3fff)
+		h := int(binary.LittleEndian.Uint16(b[28:30]) & 0x3fff)
+		return w, h, nil
+	case "VP8L":
+		bits := binary.LittleEndian.Uint32(b[21:25])
+		return int(bits&0x3fff) + 1, int((bits>>14)&0x3fff) + 1, nil
+	case "VP8X":
+		w := int(b[24]) | int(b[25])<<8 | int(b[26])<<16
+		h := int(b[27]) | int(b[28])<<8 | int(b[29])<<16
+		return w + 1, h + 1, nil
+	}
+	return 0, 0, errors.New("Unsupported WebP encoding")
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateThumbnails(t *testing.T) {
+	for _, test := range []struct {
+		expected string
+		specs    []thumbnailSpec
+		outputs  []string
+	}{
+		{"", []thumbnailSpec{{Width: 200}, {Width: 1024, Format: "webp", Pages: 3}}, []string{"pdf"}},
+		{"", []thumbnailSpec{{Width: 200}, {Width: 200, Format: "jpeg"}}, []string{"pdf"}},
+		{"Thumbnails are rendered from the pdf output, which was not requested", []thumbnailSpec{{Width: 200}}, []string{"docx"}},
+		{`Unknown thumbnail format "gif", expected png, jpeg or webp`, []thumbnailSpec{{Width: 200, Format: "gif"}}, []string{"pdf"}},
+		{"Thumbnail width must be between 1 and 4096", []thumbnailSpec{{Width: 0}}, []string{"pdf"}},
+		{"Thumbnails may cover at most 50 pages", []thumbnailSpec{{Width: 200, Pages: 51}}, []string{"pdf"}},
+		{"Thumbnail 200px png requested twice", []thumbnailSpec{{Width: 200}, {Width: 200, Format: "png"}}, []string{"pdf"}},
+	} {
+		actual := ""
+		if err := validateThumbnails(test.specs, test.outputs); err != nil {
+			actual = err.Error()
+		}
+		if actual != test.expected {
+			t.Errorf("Expected %v but got %v", test.expected, actual)
+		}
+	}
+}
+
+func TestConvertThumbnailKey(t *testing.T) {
+	actual := convertThumbnailKey("/foo/bar/baz.pptx", thumbnailSpec{Width: 200, Format: "jpeg"}, 2)
+	expected := "/foo/bar/baz-preview-p2-200w.jpg"
+	if actual != expected {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+}
+
+func TestRenderThumbnails(t *testing.T) {
+	os.Setenv("PDFTOPPM_PATH", "mock-commands/pdftoppm")
+	os.Setenv("CWEBP_PATH", "mock-commands/cwebp")
+	dir, _ := ioutil.TempDir("", "thumbnails")
+	defer os.RemoveAll(dir)
+
+	pages, err := renderThumbnails(context.Background(), "/tmp/foo.pdf", dir, thumbnailSpec{Width: 200, Format: "webp", Pages: 5})
+	if err != nil {
+		t.Fatalf("Expected nil but got %v", err)
+	}
+	leftovers, _ := filepath.Glob(filepath.Join(dir, "*.png"))
+	for _, test := range []struct {
+		expected interface{}
+		actual   interface{}
+	}{
+		{3, len(pages)},
+		{1, pages[0].Page},
+		{3, pages[2].Page},
+		{filepath.Join(dir, "200w-webp-3.webp"), pages[2].Path},
+		{0, len(leftovers)},
+	} {
+		if test.expected != test.actual {
+			t.Errorf("Expected %v but got %v", test.expected, test.actual)
+		}
+	}
+}
+
+func TestWebpSize(t *testing.T) {
+	lossy := make([]byte, 30)
+	copy(lossy, "RIFF\x00\x00\x00\x00WEBPVP8 ")
+	binary.LittleEndian.PutUint16(lossy[26:], 200)
+	binary.LittleEndian.PutUint16(lossy[28:], 141)
+	lossless := make([]byte, 30)
+	copy(lossless, "RIFF\x00\x00\x00\x00WEBPVP8L")
+	binary.LittleEndian.PutUint32(lossless[21:], (1024-1)|(724-1)<<14)
+
+	dir, _ := ioutil.TempDir("", "webp")
+	defer os.RemoveAll(dir)
+	for _, test := range []struct {
+		width  int
+		height int
+		data   []byte
+	}{
+		{200, 141, lossy},
+		{1024, 724, lossless},
+	} {
+		filename := filepath.Join(dir, "thumb.webp")
+		ioutil.WriteFile(filename, test.data, 0600)
+		w, h, err := webpSize(filename)
+		if err != nil || w != test.width || h != test.height {
+			t.Errorf("Expected %vx%v but got %vx%v %v", test.width, test.height, w, h, err)
+		}
+	}
+}